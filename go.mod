@@ -5,9 +5,11 @@ go 1.16
 require (
 	github.com/mozillazg/pkiutil v0.2.0
 	github.com/stretchr/testify v1.8.1
+	golang.org/x/sys v0.6.0
 	golang.org/x/xerrors v0.0.0-20220907171357-04be3eba64a2
 	k8s.io/api v0.27.0
 	k8s.io/apimachinery v0.27.0
 	k8s.io/client-go v0.27.0
 	k8s.io/klog/v2 v2.90.1
+	k8s.io/utils v0.0.0-20230209194617-a36077c30491
 )
@@ -0,0 +1,260 @@
+package cert
+
+import (
+	"context"
+	"reflect"
+
+	errors "golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// When CertOption.CASecretInfo is set, the CA material (CA cert and key, next and previous CA,
+// and the state of CA rotation) is saved to the CA secret, and only the server cert, server key
+// and CA cert are saved to the serving secret which is mounted into the webhook pod.
+//
+// certManager always works on a merged view of the two secrets, which looks like the secret
+// that is used when the CA secret is not set. getSecret builds the merged view and
+// createSecret/updateSecret split it back to the two secrets.
+const (
+	// resourceVersion of the CA secret that the merged view is built from
+	caSecretResourceVersionAnnotation = annotationPrefix + "ca-secret-resource-version"
+)
+
+func (c *certManager) hasCASecret() bool {
+	return c.caSecretInfo.Name != ""
+}
+
+func (c *certManager) getSecret(ctx context.Context) (*corev1.Secret, error) {
+	secret, caSecret, err := c.getSecrets(ctx)
+	if err != nil || !c.hasCASecret() {
+		return secret, err
+	}
+
+	merged := c.mergeSecrets(secret, caSecret)
+	if secret != nil && c.hasCAMaterial(secret) {
+		klog.Warningf("secret %s contains ca material, will move it to ca secret %s", c.secretInfo.Name, c.caSecretInfo.Name)
+		return c.updateSecret(ctx, merged)
+	}
+	return merged, nil
+}
+
+// readSecret is the read-only version of getSecret, CA material in the serving secret is not moved
+func (c *certManager) readSecret(ctx context.Context) (*corev1.Secret, error) {
+	secret, caSecret, err := c.getSecrets(ctx)
+	if err != nil || !c.hasCASecret() {
+		return secret, err
+	}
+	return c.mergeSecrets(secret, caSecret), nil
+}
+
+// getSecrets gets the serving secret and the CA secret, one of them may be nil when it is not found
+func (c *certManager) getSecrets(ctx context.Context) (secret, caSecret *corev1.Secret, err error) {
+	secret, err = c.secretClient.Get(ctx, c.secretInfo.Name, metav1.GetOptions{})
+	if !c.hasCASecret() {
+		return secret, nil, err
+	}
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, nil, err
+		}
+		secret = nil
+	}
+	caSecret, caErr := c.caSecretClient.Get(ctx, c.caSecretInfo.Name, metav1.GetOptions{})
+	if caErr != nil {
+		if !apierrors.IsNotFound(caErr) {
+			return nil, nil, errors.Errorf("get ca secret %s: %w", c.caSecretInfo.Name, caErr)
+		}
+		if secret == nil {
+			return nil, nil, err
+		}
+		caSecret = nil
+	}
+	return secret, caSecret, nil
+}
+
+func (c *certManager) createSecret(ctx context.Context, secret *corev1.Secret) (*corev1.Secret, error) {
+	if !c.hasCASecret() {
+		return c.secretClient.Create(ctx, secret, metav1.CreateOptions{})
+	}
+	return c.saveSecrets(ctx, secret)
+}
+
+func (c *certManager) updateSecret(ctx context.Context, secret *corev1.Secret) (*corev1.Secret, error) {
+	if !c.hasCASecret() {
+		return c.secretClient.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	return c.saveSecrets(ctx, secret)
+}
+
+// saveSecrets splits the merged view to the CA secret and the serving secret, the CA secret
+// is saved first so that the serving secret never contains a cert issued by an unsaved CA.
+func (c *certManager) saveSecrets(ctx context.Context, merged *corev1.Secret) (*corev1.Secret, error) {
+	caSecret, err := c.saveCASecret(ctx, merged)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := merged.DeepCopy()
+	for _, keys := range c.caDataKeys() {
+		if keys[0] != c.secretInfo.getCACertName() {
+			delete(secret.Data, keys[0])
+		}
+	}
+	for _, key := range caAnnotations {
+		delete(secret.Annotations, key)
+	}
+	delete(secret.Annotations, caSecretResourceVersionAnnotation)
+	if secret.ResourceVersion == "" {
+		secret, err = c.secretClient.Create(ctx, secret, metav1.CreateOptions{})
+	} else {
+		secret, err = c.secretClient.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return nil, errors.Errorf("save secret %s: %w", c.secretInfo.Name, err)
+	}
+	return c.mergeSecrets(secret, caSecret), nil
+}
+
+func (c *certManager) saveCASecret(ctx context.Context, merged *corev1.Secret) (*corev1.Secret, error) {
+	client := c.caSecretClient
+	name := c.caSecretInfo.Name
+	resourceVersion := merged.Annotations[caSecretResourceVersionAnnotation]
+
+	caSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: c.caSecretInfo.Namespace,
+		},
+	}
+	if resourceVersion != "" {
+		current, err := client.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Errorf("get ca secret %s: %w", name, err)
+		}
+		caSecret = current.DeepCopy()
+		// fail with conflict if the CA secret is changed since the merged view was built
+		caSecret.ResourceVersion = resourceVersion
+	}
+
+	data := map[string][]byte{}
+	for k, v := range caSecret.Data {
+		data[k] = v
+	}
+	for _, keys := range c.caDataKeys() {
+		delete(data, keys[1])
+		if v, ok := merged.Data[keys[0]]; ok {
+			data[keys[1]] = v
+		}
+	}
+	annotations := map[string]string{}
+	for k, v := range caSecret.Annotations {
+		annotations[k] = v
+	}
+	for _, key := range caAnnotations {
+		delete(annotations, key)
+		if v, ok := merged.Annotations[key]; ok {
+			annotations[key] = v
+		}
+	}
+
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	if resourceVersion != "" && reflect.DeepEqual(data, caSecret.Data) &&
+		reflect.DeepEqual(annotations, caSecret.Annotations) {
+		return caSecret, nil
+	}
+	caSecret.Data = data
+	caSecret.Annotations = annotations
+	var err error
+	if resourceVersion == "" {
+		klog.Infof("create ca secret %s", name)
+		caSecret, err = client.Create(ctx, caSecret, metav1.CreateOptions{})
+	} else {
+		caSecret, err = client.Update(ctx, caSecret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return nil, errors.Errorf("save ca secret %s: %w", name, err)
+	}
+	return caSecret, nil
+}
+
+// mergeSecrets builds the merged view of secret and caSecret, both of them can be nil.
+// the CA material in secret is used if caSecret is nil, so that the CA is kept
+// when moving from a single secret to separate secrets.
+func (c *certManager) mergeSecrets(secret, caSecret *corev1.Secret) *corev1.Secret {
+	merged := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      c.secretInfo.Name,
+			Namespace: c.secretInfo.Namespace,
+		},
+	}
+	if secret != nil {
+		merged = secret.DeepCopy()
+	}
+	if merged.Data == nil {
+		merged.Data = map[string][]byte{}
+	}
+	if caSecret == nil {
+		delete(merged.Annotations, caSecretResourceVersionAnnotation)
+		return merged
+	}
+
+	for _, keys := range c.caDataKeys() {
+		delete(merged.Data, keys[0])
+		if v, ok := caSecret.Data[keys[1]]; ok {
+			merged.Data[keys[0]] = v
+		}
+	}
+	if merged.Annotations == nil {
+		merged.Annotations = map[string]string{}
+	}
+	for _, key := range caAnnotations {
+		delete(merged.Annotations, key)
+		if v, ok := caSecret.Annotations[key]; ok {
+			merged.Annotations[key] = v
+		}
+	}
+	merged.Annotations[caSecretResourceVersionAnnotation] = caSecret.ResourceVersion
+	return merged
+}
+
+// hasCAMaterial reports whether the serving secret contains data that belongs to the CA secret
+func (c *certManager) hasCAMaterial(secret *corev1.Secret) bool {
+	for _, keys := range c.caDataKeys() {
+		if keys[0] == c.secretInfo.getCACertName() {
+			continue
+		}
+		if _, ok := secret.Data[keys[0]]; ok {
+			return true
+		}
+	}
+	for _, key := range append(caAnnotations, caSecretResourceVersionAnnotation) {
+		if _, ok := secret.Annotations[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// caDataKeys returns the keys of CA material in the merged view and in the CA secret
+func (c *certManager) caDataKeys() [][2]string {
+	return [][2]string{
+		{c.secretInfo.getCACertName(), c.caSecretInfo.getCACertName()},
+		{c.secretInfo.getCAKeyName(), c.caSecretInfo.getCAKeyName()},
+		{nextCACertName, nextCACertName},
+		{nextCAKeyName, nextCAKeyName},
+		{previousCACertName, previousCACertName},
+		{intermediateCACertName, intermediateCACertName},
+		{intermediateCAKeyName, intermediateCAKeyName},
+	}
+}
+
+// caAnnotations are the annotations of CA rotation state which are saved to the CA secret
+var caAnnotations = []string{
+	nextCAPublishedAtAnnotation,
+	caRotatedAtAnnotation,
+}
@@ -0,0 +1,169 @@
+package cert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// newTestCASecretCertManager returns a certManager which saves CA material to the CA secret
+func newTestCASecretCertManager(secretClient, caSecretClient *FakeSecretInterface) *certManager {
+	return &certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt: CertOption{
+			CAName:                     "ca",
+			Hosts:                      []string{"example.com"},
+			CommonName:                 "test",
+			CAValidityDuration:         time.Hour * 24 * 365,
+			ServerCertValidityDuration: time.Hour * 24 * 30,
+		},
+		secretClient:   secretClient,
+		caSecretInfo:   SecretInfo{Name: "test-ca", Namespace: "ca", CACertName: "root.pem", CAKeyName: "root-key.pem"},
+		caSecretClient: caSecretClient,
+	}
+}
+
+func TestCertManager_ensureSecret_ca_secret(t *testing.T) {
+	secretClient := &FakeSecretInterface{}
+	caSecretClient := &FakeSecretInterface{}
+	c := newTestCASecretCertManager(secretClient, caSecretClient)
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, c.certSecretIsValid(s, time.Now()))
+
+	serving := secretClient.getSecret
+	assert.Len(t, serving.Data, 3)
+	for _, name := range []string{"tls.crt", "tls.key", "ca.crt"} {
+		assert.NotEmpty(t, serving.Data[name])
+	}
+	caSecret := caSecretClient.getSecret
+	assert.Equal(t, "ca", caSecret.Namespace)
+	assert.Len(t, caSecret.Data, 2)
+	assert.Equal(t, serving.Data["ca.crt"], caSecret.Data["root.pem"])
+	assert.Equal(t, s.Data["ca.key"], caSecret.Data["root-key.pem"])
+
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, s, newS)
+	assert.Equal(t, 0, secretClient.updates)
+	assert.Equal(t, 0, caSecretClient.updates)
+}
+
+func TestCertManager_ensureSecret_ca_secret_renew_server_cert(t *testing.T) {
+	secretClient := &FakeSecretInterface{}
+	caSecretClient := &FakeSecretInterface{}
+	c := newTestCASecretCertManager(secretClient, caSecretClient)
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	ca, err := c.buildArtifactsFromSecret(s)
+	assert.NoError(t, err)
+
+	// server cert is expired
+	expiredCert, expiredKey, err := c.createCertPEM(ca, time.Now().Add(-time.Hour*2), time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	secretClient.getSecret.Data["tls.crt"] = expiredCert
+	secretClient.getSecret.Data["tls.key"] = expiredKey
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, c.certSecretIsValid(newS, time.Now()))
+	assert.Equal(t, s.Data["ca.crt"], newS.Data["ca.crt"])
+	assert.Equal(t, 1, secretClient.updates)
+	assert.Equal(t, 0, caSecretClient.updates)
+
+	// serving secret is deleted
+	secretClient.getSecret = nil
+	newS, err = c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, c.certSecretIsValid(newS, time.Now()))
+	assert.Equal(t, s.Data["ca.crt"], secretClient.getSecret.Data["ca.crt"])
+	assert.Equal(t, 0, caSecretClient.updates)
+}
+
+func TestCertManager_ensureSecret_ca_secret_server_cert_not_issued_by_ca(t *testing.T) {
+	secretClient := &FakeSecretInterface{}
+	c := newTestCASecretCertManager(secretClient, &FakeSecretInterface{})
+	_, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+
+	// CA secret was updated but serving secret was not
+	other := newTestCASecretCertManager(&FakeSecretInterface{}, &FakeSecretInterface{})
+	otherS, err := other.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	secretClient.getSecret.Data["tls.crt"] = otherS.Data["tls.crt"]
+	secretClient.getSecret.Data["tls.key"] = otherS.Data["tls.key"]
+
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.NotEqual(t, otherS.Data["tls.crt"], newS.Data["tls.crt"])
+	assert.NoError(t, c.verifyServerCertChain(newS, time.Now()))
+}
+
+func TestCertManager_ensureSecret_move_ca_to_ca_secret(t *testing.T) {
+	single := &certManager{
+		secretInfo:   SecretInfo{Name: "test"},
+		certOpt:      CertOption{CAName: "ca", Hosts: []string{"example.com"}, CommonName: "test"},
+		secretClient: &FakeSecretInterface{},
+	}
+	s, err := single.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	s.Annotations = map[string]string{caRotatedAtAnnotation: time.Now().UTC().Format(time.RFC3339)}
+
+	secretClient := &FakeSecretInterface{}
+	caSecretClient := &FakeSecretInterface{}
+	c := newTestCASecretCertManager(secretClient, caSecretClient)
+	secretClient.getSecret = s.DeepCopy()
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, s.Data["ca.crt"], newS.Data["ca.crt"])
+	assert.Equal(t, s.Data["tls.crt"], newS.Data["tls.crt"])
+
+	assert.Len(t, secretClient.getSecret.Data, 3)
+	assert.Nil(t, secretClient.getSecret.Data["ca.key"])
+	assert.Empty(t, secretClient.getSecret.Annotations)
+	assert.Equal(t, s.Data["ca.crt"], caSecretClient.getSecret.Data["root.pem"])
+	assert.Equal(t, s.Data["ca.key"], caSecretClient.getSecret.Data["root-key.pem"])
+	assert.Equal(t, s.Annotations[caRotatedAtAnnotation], caSecretClient.getSecret.Annotations[caRotatedAtAnnotation])
+}
+
+func TestWebhookCert_CheckCertSecret_does_not_move_ca(t *testing.T) {
+	single := &certManager{
+		secretInfo:   SecretInfo{Name: "test"},
+		certOpt:      CertOption{CAName: "ca", Hosts: []string{"example.com"}, CommonName: "test"},
+		secretClient: &FakeSecretInterface{},
+	}
+	s, err := single.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+
+	secretClient := &FakeSecretInterface{getSecret: s.DeepCopy()}
+	caSecretClient := &FakeSecretInterface{}
+	w := &WebhookCert{
+		certmanager: &certManager{
+			secretInfo:     SecretInfo{Name: "test"},
+			certOpt:        single.certOpt,
+			secretClient:   secretClient,
+			caSecretInfo:   SecretInfo{Name: "test-ca", Namespace: "ca"},
+			caSecretClient: caSecretClient,
+		},
+	}
+	assert.NoError(t, w.CheckCertSecret(context.TODO()))
+	assert.Equal(t, 0, secretClient.updates)
+	assert.Equal(t, s.Data, secretClient.getSecret.Data)
+	assert.Nil(t, caSecretClient.getSecret)
+}
+
+func TestCertManager_ensureSecret_ca_secret_conflict(t *testing.T) {
+	caSecretClient := &FakeSecretInterface{}
+	c := newTestCASecretCertManager(&FakeSecretInterface{}, caSecretClient)
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+
+	// CA secret is changed by others after the merged view was built
+	caSecretClient.save(caSecretClient.getSecret)
+	setAnnotationTime(s, caRotatedAtAnnotation, time.Now())
+	_, err = c.updateSecret(context.TODO(), s)
+	assert.Error(t, err)
+	assert.True(t, apierrors.IsConflict(err))
+}
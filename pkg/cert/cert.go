@@ -4,21 +4,26 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	errors "golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	klog "k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 )
 
 type CertOption struct {
@@ -30,26 +35,102 @@ type CertOption struct {
 	Hosts []string
 	// CommonName for server cert
 	CommonName string
-	// RSA key size, default: 2048
+	// key algorithm for CA and server cert, default: RSA
+	KeyAlgorithm KeyAlgorithm
+	// RSA key size, only used when KeyAlgorithm is RSA, default: 2048
 	RSAKeySize int
 	// cert dir to mount secret
 	CertDir string
+	// retry schedule of checking whether the secret is mounted to CertDir in EnsureCertReady,
+	// default: start with 1 second, double the interval with jitter, at most 10 times
+	MountCheckBackoff *wait.Backoff
+	// overall deadline of checking whether the secret is mounted to CertDir, default: no deadline
+	MountCheckTimeout time.Duration
+	// serve the server cert from the secret in memory by WebhookCert.GetCertificate instead of
+	// the files in CertDir, EnsureCertReady does not wait for the secret to be mounted.
+	// WatchAndEnsureWebhooksCA reads the secret every 10 seconds to serve the renewed cert
+	ServeFromSecret bool
 	// cert will be expired after this duration, default: 100 years
 	CertValidityDuration time.Duration
+	// CA cert will be expired after this duration, default: CertValidityDuration
+	CAValidityDuration time.Duration
+	// server cert will be expired after this duration, default: CertValidityDuration.
+	// server cert is renewed with the existing CA when only the server cert is expiring
+	ServerCertValidityDuration time.Duration
+	// renew cert when the remaining validity is less than this duration, default: 7 days.
+	// if it is not less than the cert's whole lifetime, 1/3 of the lifetime is used instead
+	RenewBefore time.Duration
+	// renew cert when the remaining validity is less than this percentage (1-99) of
+	// the cert's whole lifetime, takes precedence over RenewBefore
+	RenewBeforePercentage int
+	// check and renew certs at this interval in WatchAndEnsureWebhooksCA, default: 1 hour.
+	// certs are also checked when they reach renewal time before this interval
+	RenewCheckInterval time.Duration
+	// when CA is going to expire, a new CA is published to caBundle first, after this delay
+	// the server cert is switched to the new CA, and after this delay again the old CA is
+	// dropped from caBundle. default: 10 minutes, negative value means rotating CA immediately
+	CAPropagationDelay time.Duration
+	// which old certs are kept in caBundle, default: keep one old cert
+	CABundleRetention CABundleRetention
 	// Deprecated: use Organizations instead
 	CAOrganizations []string
 	// Deprecated: user Hosts instead
 	DNSNames []string
 
 	SecretInfo SecretInfo
+	// secret to save CA cert, CA key and the state of CA rotation, only the server cert,
+	// server key and CA cert are saved to SecretInfo when it is set. CertName, KeyName and
+	// DontSaveCAKey of it are not used. default namespace: SecretInfo.Namespace,
+	// default: save CA material to SecretInfo
+	CASecretInfo SecretInfo
+	// store to save SecretInfo, e.g. NewDirStore for development. default: Secret of SecretInfo.Namespace
+	SecretStore SecretStore
+	// store to save CASecretInfo, e.g. NewConfigMapStore when the CA key is not saved.
+	// default: Secret of the namespace of CASecretInfo
+	CASecretStore SecretStore
+	// encrypt the CA private keys saved to secret, default: not encrypted
+	CAKeyEncryption *CAKeyEncryption
+	// serialize checking and issuing certs across replicas with a Lease, default: not used
+	IssueLease *IssueLease
+	// issue the server cert by an intermediate CA signed by the self-generated root CA,
+	// only the root CA is injected into caBundle. ignored when the server cert is not issued by the self-generated CA
+	IntermediateCA bool
+	// issue the server cert by an existing CA instead of a self-generated CA,
+	// the CA key is never saved to secret
+	ExternalCA *ExternalCA
+	// request the server cert from a signer of the cluster through the CertificateSigningRequest API
+	// instead of issuing it by a CA
+	CSRSigner *CSRSigner
+	// issue the server cert by a custom Issuer, e.g. Vault PKI.
+	// only one of ExternalCA, CSRSigner and Issuer can be set
+	Issuer Issuer
 }
 
+// ErrStaleMountedCerts is returned by EnsureCertReady when the certs mounted to CertDir are
+// different from the secret, e.g. kubelet has not synced the renewed certs yet
+var ErrStaleMountedCerts = errors.New("mounted certs are stale")
+
 type WebhookCert struct {
 	certOpt CertOption
 
 	certmanager    *certManager
 	webhookmanager *webhookManager
 	checkerClient  checkerClientInterface
+
+	// serialize ensureCert, it is called by the renewal and the watch of webhooks at the same time,
+	// the calls hold IssueLease with the same identity and can not be serialized by it
+	ensureMu sync.Mutex
+	// the secret of the last successful ensureCert, guarded by ensureMu
+	ensuredSecret *corev1.Secret
+
+	// server cert for GetCertificate and the PEM data it is loaded from
+	servingCertMu  sync.RWMutex
+	servingCert    *tls.Certificate
+	servingCertPEM []byte
+	servingKeyPEM  []byte
+	// watcher of the server cert in CertDir
+	certWatcherMu sync.Mutex
+	certWatcher   *CertWatcher
 }
 
 type checkerClientInterface interface {
@@ -57,34 +138,54 @@ type checkerClientInterface interface {
 }
 
 func NewWebhookCert(certOpt CertOption, webhooks []WebhookInfo, kubeclient kubernetes.Interface, dyclient dynamic.Interface) *WebhookCert {
+	caSecretInfo := certOpt.getCASecretInfo()
 	return &WebhookCert{
 		certOpt: certOpt,
 		certmanager: &certManager{
-			secretInfo:   certOpt.SecretInfo,
-			certOpt:      certOpt,
-			secretClient: kubeclient.CoreV1().Secrets(certOpt.SecretInfo.Namespace),
+			secretInfo:             certOpt.SecretInfo,
+			certOpt:                certOpt,
+			secretClient:           certOpt.getSecretStore(kubeclient),
+			clock:                  clock.RealClock{},
+			caSecretInfo:           caSecretInfo,
+			caSecretClient:         certOpt.getCASecretStore(kubeclient, caSecretInfo.Namespace),
+			externalCASecretClient: kubeclient.CoreV1().Secrets(certOpt.getExternalCASecretNamespace()),
+			csrClient:              kubeclient.CertificatesV1().CertificateSigningRequests(),
+			leaseClient:            kubeclient.CoordinationV1().Leases(certOpt.getIssueLeaseNamespace()),
 		},
-		webhookmanager: newWebhookManager(webhooks, dyclient),
+		webhookmanager: newWebhookManager(webhooks, certOpt.CABundleRetention, dyclient),
 		checkerClient: &http.Client{Transport: &http.Transport{
 			// TODO: use ca from secret
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			// check the cert of a new connection every time, the served cert may be renewed
+			DisableKeepAlives: true,
 		}},
 	}
 }
 
 func (w *WebhookCert) EnsureCertReady(ctx context.Context) error {
-	if err := w.ensureCert(ctx); err != nil {
+	secret, err := w.ensureCert(ctx)
+	if err != nil {
 		return errors.Errorf(": %w", err)
 	}
 	klog.Info("ensure cert success")
-	if err := w.ensureCertsMounted(ctx); err != nil {
+	if w.certOpt.ServeFromSecret {
+		return nil
+	}
+	if err := w.ensureCertsMounted(ctx, secret); err != nil {
 		return errors.Errorf(": %w", err)
 	}
 	klog.Info("ensure cert mounted success")
 	return nil
 }
 
+// WatchAndEnsureWebhooksCA watches webhooks to restore caBundle and
+// renews certs periodically, it will block until ctx is done
 func (w *WebhookCert) WatchAndEnsureWebhooksCA(ctx context.Context) error {
+	go w.renewCertsPeriodically(ctx)
+	if w.certOpt.ServeFromSecret {
+		go w.reloadServingCertPeriodically(ctx)
+	}
+
 	events := make(chan watch.Event)
 	watchTimeout := time.Hour * 23
 	if os.Getenv("WEBHOOKCERT_DEBUG_WATCH") == "true" {
@@ -99,7 +200,7 @@ func (w *WebhookCert) WatchAndEnsureWebhooksCA(ctx context.Context) error {
 				err := w.webhookmanager.watchChanges(ctx, events, info, timeout)
 				if err != nil {
 					if apierrors.IsNotFound(err) {
-						klog.Warningf("webhook %s is not found, delay watch", info.Name)
+						klog.Warningf("webhook %s is not found, delay watch", info.displayName())
 						time.Sleep(wait.Jitter(time.Hour*24, 0.1))
 						return
 					}
@@ -124,12 +225,64 @@ func (w *WebhookCert) WatchAndEnsureWebhooksCA(ctx context.Context) error {
 }
 
 func (w *WebhookCert) ensureCAWhenWebhookChange(ctx context.Context) error {
-	if err := w.ensureCert(ctx); err != nil {
+	if _, err := w.ensureCert(ctx); err != nil {
 		return errors.Errorf(": %w", err)
 	}
 	return nil
 }
 
+func (w *WebhookCert) renewCertsPeriodically(ctx context.Context) {
+	interval := w.certOpt.getRenewCheckInterval()
+	next := interval
+	// the certs ensured by EnsureCertReady may need to be renewed before the first interval
+	w.ensureMu.Lock()
+	secret := w.ensuredSecret
+	w.ensureMu.Unlock()
+	if secret != nil {
+		next = w.renewCheckDelay(secret, interval)
+	}
+	for {
+		klog.V(4).Infof("next renewal check of certs will be after %s", next)
+		timer := time.NewTimer(wait.Jitter(next, 0.1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		secret, err := w.ensureCert(ctx)
+		if err != nil {
+			klog.Errorf("renew certs failed: %+v", err)
+			next = interval
+			if next > renewRetryInterval {
+				next = renewRetryInterval
+			}
+			continue
+		}
+		next = w.renewCheckDelay(secret, interval)
+	}
+}
+
+// renewCheckDelay returns the delay of the next renewal check of the certs in secret,
+// it is not longer than interval
+func (w *WebhookCert) renewCheckDelay(secret *corev1.Secret, interval time.Duration) time.Duration {
+	renewAt, err := w.certmanager.nextRenewTime(secret)
+	if err != nil {
+		klog.Errorf("get renewal time of certs failed: %+v", err)
+		return interval
+	}
+	d := renewAt.Sub(w.certmanager.now())
+	// avoid busy loop when certs can not be renewed in time
+	if d < renewMinInterval {
+		d = renewMinInterval
+	}
+	if d < interval {
+		return d
+	}
+	return interval
+}
+
 func (w *WebhookCert) CheckServerStartedWithTimeout(addr string, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
 	defer cancel()
@@ -159,7 +312,16 @@ func (w *WebhookCert) CheckServerCertValidWithTimeout(addr string, timeout time.
 	return w.CheckServerCertValid(ctx, addr)
 }
 
+// CheckServerCertValid checks whether the webhook server at addr serves the current server cert.
+// the current server cert is the cert of the secret with ServeFromSecret, the cert last loaded by
+// the watcher if WebhookCert.CertWatcher is called (its reload failure is also reported),
+// otherwise the cert in CertDir.
 func (w *WebhookCert) CheckServerCertValid(ctx context.Context, addr string) error {
+	if watcher := w.getCertWatcher(); watcher != nil {
+		if err := watcher.ReloadError(); err != nil {
+			return errors.Errorf("reload server cert from %s: %w", w.certOpt.CertDir, err)
+		}
+	}
 	url := addr
 	if !strings.HasPrefix(url, "https://") {
 		url = fmt.Sprintf("https://%s", url)
@@ -179,9 +341,9 @@ func (w *WebhookCert) CheckServerCertValid(ctx context.Context, addr string) err
 		return errors.New("webhook server does not serve TLS certificate")
 	}
 	respCerts := resp.TLS.PeerCertificates
-	currentCerts, err := tls.LoadX509KeyPair(w.certOpt.getServerCertPath(), w.certOpt.getServerKeyPath())
+	currentCerts, err := w.currentServerCert()
 	if err != nil {
-		return errors.Errorf("load server cert from %s: %w", w.certOpt.CertDir, err)
+		return err
 	}
 	if len(respCerts) != len(currentCerts.Certificate) {
 		return errors.Errorf("certificate chain mismatch: %d != %d", len(respCerts), len(currentCerts.Certificate))
@@ -194,38 +356,83 @@ func (w *WebhookCert) CheckServerCertValid(ctx context.Context, addr string) err
 	return nil
 }
 
-func (w *WebhookCert) ensureCert(ctx context.Context) error {
-	secret, err := w.certmanager.ensureSecret(ctx)
+// CheckCertSecret checks whether the certs in the secret are valid, an *InvalidCertError is
+// returned to explain why the certs are invalid and will be issued again by EnsureCertReady
+func (w *WebhookCert) CheckCertSecret(ctx context.Context) error {
+	secret, err := w.certmanager.readSecret(ctx)
 	if err != nil {
-		return errors.Errorf("ensure secret: %w", err)
+		return errors.Errorf("get secret: %w", err)
 	}
-	klog.Info("ensure secret success")
-	ka, err := w.certmanager.buildArtifactsFromSecret(secret)
+	return w.certmanager.certSecretIsValid(secret, w.certmanager.now())
+}
+
+func (w *WebhookCert) ensureCert(ctx context.Context) (*corev1.Secret, error) {
+	w.ensureMu.Lock()
+	defer w.ensureMu.Unlock()
+	var secret *corev1.Secret
+	// the next CA is marked as published under the lease too,
+	// so that other replicas do not move the CA rotation on before it is injected
+	err := w.certmanager.withIssueLease(ctx, func() error {
+		var err error
+		secret, err = w.certmanager.ensureSecret(ctx)
+		if err != nil {
+			return errors.Errorf("ensure secret: %w", err)
+		}
+		klog.Info("ensure secret success")
+		if _, err := w.certmanager.buildArtifactsFromSecret(secret); err != nil {
+			return errors.Errorf("parse secret: %w", err)
+		}
+		trusted, untrusted := w.certmanager.caBundle(secret, w.certmanager.now())
+		if err := w.webhookmanager.ensureCA(ctx, trusted, untrusted); err != nil {
+			return err
+		}
+		klog.Info("ensure webhook ca config success")
+		secret, err = w.certmanager.markCAPublished(ctx, secret)
+		if err != nil {
+			return errors.Errorf("mark next ca as published: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return errors.Errorf("parse secret: %w", err)
+		return nil, err
 	}
-	err = w.webhookmanager.ensureCA(ctx, ka.certPEM)
-	if err == nil {
-		klog.Info("ensure webhook ca config success")
+	if err := w.setServingCert(secret); err != nil {
+		return nil, err
 	}
-	return err
+	w.ensuredSecret = secret
+	return secret, nil
 }
 
-func (w *WebhookCert) ensureCertsMounted(ctx context.Context) error {
+// ensureCertsMounted waits until the server cert and key in CertDir are the same as secret,
+// the mounted files are updated by kubelet a while after secret is changed.
+// the secret is read again when they are different, it may be renewed by other replicas in the meantime
+func (w *WebhookCert) ensureCertsMounted(ctx context.Context, secret *corev1.Secret) error {
+	if timeout := w.certOpt.MountCheckTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var lastErr error
 	checkFn := func(ctx context.Context) (bool, error) {
-		certFile := filepath.Join(w.certOpt.CertDir, w.certOpt.SecretInfo.getCertName())
-		_, err := os.Stat(certFile)
-		if err == nil {
-			return true, nil
+		lastErr = w.checkCertsMounted(secret)
+		if errors.Is(lastErr, ErrStaleMountedCerts) {
+			current, err := w.certmanager.readSecret(ctx)
+			if err != nil {
+				klog.Warningf("get secret %s failed: %s", w.certOpt.SecretInfo.Name, err)
+			} else {
+				secret = current
+				lastErr = w.checkCertsMounted(secret)
+			}
 		}
-		return false, nil
+		if lastErr != nil {
+			klog.V(4).Infof("certs are not ready in %s: %s", w.certOpt.CertDir, lastErr)
+		}
+		return lastErr == nil, nil
 	}
-	if err := wait.ExponentialBackoffWithContext(ctx, wait.Backoff{
-		Duration: 1 * time.Second,
-		Factor:   2,
-		Jitter:   1,
-		Steps:    10,
-	}, checkFn); err != nil {
+	if err := wait.ExponentialBackoffWithContext(ctx, w.certOpt.getMountCheckBackoff(), checkFn); err != nil {
+		if lastErr != nil {
+			return errors.Errorf("max retries for checking certs in %s: %w", w.certOpt.CertDir, lastErr)
+		}
 		return errors.Errorf("max retries for checking certs existence: %w", err)
 	}
 
@@ -233,6 +440,33 @@ func (w *WebhookCert) ensureCertsMounted(ctx context.Context) error {
 	return nil
 }
 
+// checkCertsMounted checks whether the server cert and key in CertDir are the same as secret
+func (w *WebhookCert) checkCertsMounted(secret *corev1.Secret) error {
+	info := w.certOpt.SecretInfo
+	for _, name := range []string{info.getCertName(), info.getKeyName()} {
+		data, err := ioutil.ReadFile(filepath.Join(w.certOpt.CertDir, name))
+		if err != nil {
+			return errors.Errorf("read %s: %w", name, err)
+		}
+		if !bytes.Equal(data, secret.Data[name]) {
+			return errors.Errorf("%s is different from secret %s: %w", name, info.Name, ErrStaleMountedCerts)
+		}
+	}
+	return nil
+}
+
+func (c CertOption) getMountCheckBackoff() wait.Backoff {
+	if c.MountCheckBackoff != nil {
+		return *c.MountCheckBackoff
+	}
+	return wait.Backoff{
+		Duration: 1 * time.Second,
+		Factor:   2,
+		Jitter:   1,
+		Steps:    10,
+	}
+}
+
 func (c CertOption) getCertValidityDuration() time.Duration {
 	if c.CertValidityDuration == 0 {
 		return certValidityDuration
@@ -240,6 +474,102 @@ func (c CertOption) getCertValidityDuration() time.Duration {
 	return c.CertValidityDuration
 }
 
+func (c CertOption) getCAValidityDuration() time.Duration {
+	if c.CAValidityDuration == 0 {
+		return c.getCertValidityDuration()
+	}
+	return c.CAValidityDuration
+}
+
+func (c CertOption) getServerCertValidityDuration() time.Duration {
+	if c.ServerCertValidityDuration == 0 {
+		return c.getCertValidityDuration()
+	}
+	return c.ServerCertValidityDuration
+}
+
+func (c CertOption) getRenewBefore(cert *x509.Certificate) time.Duration {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if c.RenewBeforePercentage > 0 && c.RenewBeforePercentage < 100 {
+		return lifetime * time.Duration(c.RenewBeforePercentage) / 100
+	}
+	renew := c.RenewBefore
+	if renew <= 0 {
+		renew = renewBefore
+	}
+	if renew >= lifetime {
+		renew = lifetime / 3
+	}
+	return renew
+}
+
+func (c CertOption) getRenewCheckInterval() time.Duration {
+	if c.RenewCheckInterval <= 0 {
+		return renewCheckInterval
+	}
+	return c.RenewCheckInterval
+}
+
+func (c CertOption) getCAPropagationDelay() time.Duration {
+	if c.CAPropagationDelay == 0 {
+		return caPropagationDelay
+	}
+	return c.CAPropagationDelay
+}
+
+func (c CertOption) getSecretStore(kubeclient kubernetes.Interface) SecretStore {
+	if c.SecretStore != nil {
+		return c.SecretStore
+	}
+	return kubeclient.CoreV1().Secrets(c.SecretInfo.Namespace)
+}
+
+func (c CertOption) getCASecretStore(kubeclient kubernetes.Interface, namespace string) SecretStore {
+	if c.CASecretStore != nil {
+		return c.CASecretStore
+	}
+	return kubeclient.CoreV1().Secrets(namespace)
+}
+
+func (c CertOption) getIssueLeaseNamespace() string {
+	if c.IssueLease != nil && c.IssueLease.Namespace != "" {
+		return c.IssueLease.Namespace
+	}
+	return c.SecretInfo.Namespace
+}
+
+func (c CertOption) getCASecretInfo() SecretInfo {
+	info := c.CASecretInfo
+	if info.Name != "" && info.Namespace == "" {
+		info.Namespace = c.SecretInfo.Namespace
+	}
+	return info
+}
+
+func (c CertOption) validateCASource() error {
+	sources := 0
+	if c.ExternalCA != nil {
+		sources++
+	}
+	if c.CSRSigner != nil {
+		sources++
+	}
+	if c.Issuer != nil {
+		sources++
+	}
+	if sources > 1 {
+		return errors.New("only one of ExternalCA, CSRSigner and Issuer can be set")
+	}
+	return nil
+}
+
+func (c CertOption) getExternalCASecretNamespace() string {
+	if c.ExternalCA == nil || c.ExternalCA.Secret.Namespace == "" {
+		return c.SecretInfo.Namespace
+	}
+	return c.ExternalCA.Secret.Namespace
+}
+
 func (c CertOption) getHots() []string {
 	hosts := []string{}
 	hosts = append(hosts, c.Hosts...)
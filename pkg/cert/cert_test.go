@@ -12,15 +12,18 @@ import (
 	"path"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 )
 
@@ -47,7 +50,7 @@ func TestWebhookCert_ensureCert(t *testing.T) {
 		},
 	}
 
-	err := w.ensureCert(context.TODO())
+	_, err := w.ensureCert(context.TODO())
 	assert.NoError(t, err)
 	assert.NotNil(t, secretClient.gotCreateSecret)
 
@@ -57,6 +60,155 @@ func TestWebhookCert_ensureCert(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestWebhookCert_renewCertsPeriodically(t *testing.T) {
+	certOpt := CertOption{
+		CAName:             "ca",
+		Hosts:              []string{"example.com"},
+		CommonName:         "test",
+		RenewCheckInterval: time.Millisecond * 100,
+		SecretInfo:         SecretInfo{Name: "test"},
+	}
+	secretClient := &FakeSecretInterface{}
+	w := &WebhookCert{
+		certOpt: certOpt,
+		certmanager: &certManager{
+			secretInfo:   certOpt.SecretInfo,
+			certOpt:      certOpt,
+			secretClient: secretClient,
+		},
+		webhookmanager: &webhookManager{},
+	}
+	secret, err := w.ensureCert(context.TODO())
+	assert.NoError(t, err)
+
+	ca, err := w.certmanager.buildArtifactsFromSecret(secret)
+	assert.NoError(t, err)
+	expiredCert, expiredKey, err := w.certmanager.createCertPEM(ca, time.Now().Add(-time.Hour*2), time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	secretClient.getSecret = secret.DeepCopy()
+	secretClient.getSecret.Data["tls.crt"] = expiredCert
+	secretClient.getSecret.Data["tls.key"] = expiredKey
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.renewCertsPeriodically(ctx)
+
+	assert.Eventually(t, func() bool {
+		return secretClient.gotUpdateSecret != nil
+	}, time.Second*5, time.Millisecond*50)
+}
+
+// serialSecretStore records the max number of ensureCert calls which use the store at the same time
+type serialSecretStore struct {
+	*FakeSecretInterface
+	mu       sync.Mutex
+	inflight int
+	max      int
+}
+
+func (s *serialSecretStore) enter() {
+	s.mu.Lock()
+	s.inflight++
+	if s.inflight > s.max {
+		s.max = s.inflight
+	}
+	s.mu.Unlock()
+	time.Sleep(time.Millisecond * 20)
+}
+
+func (s *serialSecretStore) exit() {
+	s.mu.Lock()
+	s.inflight--
+	s.mu.Unlock()
+}
+
+func (s *serialSecretStore) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Secret, error) {
+	s.enter()
+	defer s.exit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.FakeSecretInterface.Get(ctx, name, opts)
+}
+
+func (s *serialSecretStore) Create(ctx context.Context, secret *corev1.Secret, opts metav1.CreateOptions) (*corev1.Secret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.FakeSecretInterface.Create(ctx, secret, opts)
+}
+
+func (s *serialSecretStore) Update(ctx context.Context, secret *corev1.Secret, opts metav1.UpdateOptions) (*corev1.Secret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.FakeSecretInterface.Update(ctx, secret, opts)
+}
+
+func TestWebhookCert_renewCheckDelay(t *testing.T) {
+	certOpt := CertOption{
+		CAName:                     "ca",
+		Hosts:                      []string{"example.com"},
+		CommonName:                 "test",
+		ServerCertValidityDuration: time.Minute * 3,
+		RenewBefore:                time.Minute,
+		SecretInfo:                 SecretInfo{Name: "test"},
+	}
+	w := &WebhookCert{
+		certOpt: certOpt,
+		certmanager: &certManager{
+			secretInfo:   certOpt.SecretInfo,
+			certOpt:      certOpt,
+			secretClient: &FakeSecretInterface{},
+		},
+		webhookmanager: &webhookManager{},
+	}
+	secret, err := w.ensureCert(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, secret, w.ensuredSecret)
+
+	// the server cert is renewed before the first interval
+	assert.InDelta(t, float64(time.Minute*2), float64(w.renewCheckDelay(w.ensuredSecret, time.Hour)), float64(time.Second*5))
+	assert.Equal(t, time.Minute, w.renewCheckDelay(w.ensuredSecret, time.Minute))
+
+	ca, err := w.certmanager.buildArtifactsFromSecret(secret)
+	assert.NoError(t, err)
+	expiredCert, expiredKey, err := w.certmanager.createCertPEM(ca, time.Now().Add(-time.Hour*2), time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	secret.Data["tls.crt"] = expiredCert
+	secret.Data["tls.key"] = expiredKey
+	assert.Equal(t, renewMinInterval, w.renewCheckDelay(secret, time.Hour))
+}
+
+func TestWebhookCert_ensureCert_serialized(t *testing.T) {
+	certOpt := CertOption{
+		CAName:     "ca",
+		Hosts:      []string{"example.com"},
+		CommonName: "test",
+		SecretInfo: SecretInfo{Name: "test"},
+	}
+	store := &serialSecretStore{FakeSecretInterface: &FakeSecretInterface{}}
+	w := &WebhookCert{
+		certOpt: certOpt,
+		certmanager: &certManager{
+			secretInfo:   certOpt.SecretInfo,
+			certOpt:      certOpt,
+			secretClient: store,
+		},
+		webhookmanager: &webhookManager{},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := w.ensureCert(context.TODO())
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, store.max)
+	assert.Equal(t, 0, store.updates)
+}
+
 func TestCertOption_getCertValidityDuration(t *testing.T) {
 	type fields struct {
 		CertValidityDuration time.Duration
@@ -91,6 +243,99 @@ func TestCertOption_getCertValidityDuration(t *testing.T) {
 	}
 }
 
+func TestCertOption_getCAAndServerCertValidityDuration(t *testing.T) {
+	tests := []struct {
+		name           string
+		opt            CertOption
+		wantCA         time.Duration
+		wantServerCert time.Duration
+	}{
+		{
+			name:           "default",
+			opt:            CertOption{},
+			wantCA:         certValidityDuration,
+			wantServerCert: certValidityDuration,
+		},
+		{
+			name: "fallback to CertValidityDuration",
+			opt: CertOption{
+				CertValidityDuration: time.Hour,
+			},
+			wantCA:         time.Hour,
+			wantServerCert: time.Hour,
+		},
+		{
+			name: "with value",
+			opt: CertOption{
+				CertValidityDuration:       time.Hour,
+				CAValidityDuration:         time.Hour * 2,
+				ServerCertValidityDuration: time.Minute,
+			},
+			wantCA:         time.Hour * 2,
+			wantServerCert: time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantCA, tt.opt.getCAValidityDuration())
+			assert.Equal(t, tt.wantServerCert, tt.opt.getServerCertValidityDuration())
+		})
+	}
+}
+
+func TestCertOption_getRenewBefore(t *testing.T) {
+	now := time.Now()
+	cert := &x509.Certificate{
+		NotBefore: now,
+		NotAfter:  now.Add(time.Hour * 24 * 30),
+	}
+	shortCert := &x509.Certificate{
+		NotBefore: now,
+		NotAfter:  now.Add(time.Hour * 24 * 3),
+	}
+	tests := []struct {
+		name string
+		opt  CertOption
+		cert *x509.Certificate
+		want time.Duration
+	}{
+		{
+			name: "default",
+			cert: cert,
+			want: renewBefore,
+		},
+		{
+			name: "with value",
+			opt:  CertOption{RenewBefore: time.Hour},
+			cert: cert,
+			want: time.Hour,
+		},
+		{
+			name: "not less than lifetime",
+			opt:  CertOption{},
+			cert: shortCert,
+			want: time.Hour * 24,
+		},
+		{
+			name: "with percentage",
+			opt:  CertOption{RenewBefore: time.Hour, RenewBeforePercentage: 10},
+			cert: cert,
+			want: time.Hour * 24 * 3,
+		},
+		{
+			name: "invalid percentage",
+			opt:  CertOption{RenewBefore: time.Hour, RenewBeforePercentage: 100},
+			cert: cert,
+			want: time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.opt.getRenewBefore(tt.cert))
+		})
+	}
+}
+
 func TestCertOption_getHots(t *testing.T) {
 	type fields struct {
 		Hosts    []string
@@ -364,3 +609,209 @@ func TestWebhookCert_WatchAndEnsureWebhooksCA(t *testing.T) {
 	cancel()
 	time.Sleep(time.Second)
 }
+
+// notifyUpdateResource sends the updated objects to updated
+type notifyUpdateResource struct {
+	*mockResourceInterface
+	updated chan *unstructured.Unstructured
+}
+
+func (r *notifyUpdateResource) Update(ctx context.Context, obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	r.updated <- obj.DeepCopy()
+	return obj, nil
+}
+
+func TestWebhookCert_WatchAndEnsureWebhooksCA_restore(t *testing.T) {
+	tests := []struct {
+		info     WebhookInfo
+		newObj   func(caBundle string) *unstructured.Unstructured
+		caBundle func(t *testing.T, obj *unstructured.Unstructured) string
+		resource string
+	}{
+		{
+			info:     WebhookInfo{Type: CRDConversionV1, Name: "foos.example.com"},
+			newObj:   newTestCRD,
+			caBundle: crdCABundle,
+			resource: "customresourcedefinitions",
+		},
+		{
+			info:     WebhookInfo{Type: APIServiceV1, Name: "v1.example.com"},
+			newObj:   newTestAPIService,
+			caBundle: apiServiceCABundle,
+			resource: "apiservices",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(string(tt.info.Type), func(t *testing.T) {
+			certOpt := CertOption{
+				CAName:     "test",
+				Hosts:      []string{"test.default.svc"},
+				CommonName: "test.default.svc",
+				SecretInfo: SecretInfo{Name: "test", Namespace: "default"},
+			}
+			secretClient := &FakeSecretInterface{}
+			watcher := &mockWatchInterface{events: make(chan watch.Event, 10)}
+			res := &notifyUpdateResource{
+				mockResourceInterface: &mockResourceInterface{
+					getData: &mockResourceInterfaceData{
+						data: tt.newObj(caPemForTestB),
+					},
+					w: watcher,
+				},
+				updated: make(chan *unstructured.Unstructured, 10),
+			}
+			var gvrs []schema.GroupVersionResource
+			var mu sync.Mutex
+			m := &webhookManager{
+				webhooks: []WebhookInfo{tt.info},
+				resourceClientGetter: func(resource schema.GroupVersionResource) resourceInterface {
+					mu.Lock()
+					defer mu.Unlock()
+					gvrs = append(gvrs, resource)
+					return res
+				},
+			}
+			w := &WebhookCert{
+				certOpt: certOpt,
+				certmanager: &certManager{
+					secretInfo:   certOpt.SecretInfo,
+					certOpt:      certOpt,
+					secretClient: secretClient,
+				},
+				webhookmanager: m,
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go w.WatchAndEnsureWebhooksCA(ctx)
+
+			// caBundle is tampered
+			watcher.events <- watch.Event{Type: watch.Modified, Object: tt.newObj(caPemForTestB)}
+			select {
+			case obj := <-res.updated:
+				caBundle := tt.caBundle(t, obj)
+				assert.Contains(t, caBundle, strings.TrimSpace(string(secretClient.gotCreateSecret.Data["ca.crt"])))
+			case <-time.After(time.Second * 10):
+				assert.Fail(t, "caBundle is not restored")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, gvr := range gvrs {
+				assert.Equal(t, tt.resource, gvr.Resource)
+			}
+		})
+	}
+}
+
+func TestWebhookCert_WatchAndEnsureWebhooksCA_label_selector(t *testing.T) {
+	certOpt := CertOption{
+		CAName:     "test",
+		Hosts:      []string{"test.default.svc"},
+		CommonName: "test.default.svc",
+		SecretInfo: SecretInfo{Name: "test", Namespace: "default"},
+	}
+	watcher := &mockWatchInterface{events: make(chan watch.Event, 10)}
+	res := &notifyUpdateResource{
+		mockResourceInterface: &mockResourceInterface{
+			listData: &unstructured.UnstructuredList{Items: []unstructured.Unstructured{
+				newTestValidatingWebhookConfiguration(t, "release-a", ""),
+			}},
+			w: watcher,
+		},
+		updated: make(chan *unstructured.Unstructured, 10),
+	}
+	w := &WebhookCert{
+		certOpt: certOpt,
+		certmanager: &certManager{
+			secretInfo:   certOpt.SecretInfo,
+			certOpt:      certOpt,
+			secretClient: &FakeSecretInterface{},
+		},
+		webhookmanager: &webhookManager{
+			webhooks: []WebhookInfo{
+				{
+					Type:          ValidatingV1,
+					LabelSelector: "app.kubernetes.io/instance=test",
+				},
+			},
+			resourceClientGetter: func(resource schema.GroupVersionResource) resourceInterface {
+				return res
+			},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.WatchAndEnsureWebhooksCA(ctx)
+
+	receiveUpdated := func() string {
+		select {
+		case obj := <-res.updated:
+			return obj.GetName()
+		case <-time.After(time.Second * 10):
+			assert.Fail(t, "webhook is not updated")
+			return ""
+		}
+	}
+
+	a := newTestValidatingWebhookConfiguration(t, "release-a", "")
+	watcher.events <- watch.Event{Type: watch.Added, Object: &a}
+	assert.Equal(t, "release-a", receiveUpdated())
+
+	// a new configuration appears later
+	res.listData.Items = append(res.listData.Items, newTestValidatingWebhookConfiguration(t, "release-b", ""))
+	b := newTestValidatingWebhookConfiguration(t, "release-b", "")
+	watcher.events <- watch.Event{Type: watch.Added, Object: &b}
+	updated := []string{receiveUpdated(), receiveUpdated()}
+	assert.ElementsMatch(t, []string{"release-a", "release-b"}, updated)
+}
+
+func TestWebhookCert_ensureCertsMounted(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := newTestServerCertPEM(t)
+	secret := &corev1.Secret{Data: map[string][]byte{"tls.crt": cert, "tls.key": key}}
+	certOpt := CertOption{
+		CertDir:           dir,
+		SecretInfo:        SecretInfo{Name: "test"},
+		MountCheckBackoff: &wait.Backoff{Duration: time.Millisecond * 10, Factor: 1, Steps: 3},
+	}
+	secretClient := &FakeSecretInterface{getSecret: secret.DeepCopy()}
+	w := &WebhookCert{
+		certOpt: certOpt,
+		certmanager: &certManager{
+			secretInfo:   certOpt.SecretInfo,
+			certOpt:      certOpt,
+			secretClient: secretClient,
+		},
+	}
+
+	err := w.ensureCertsMounted(context.TODO(), secret)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.False(t, errors.Is(err, ErrStaleMountedCerts))
+
+	// the files of the old secret are still mounted
+	oldCert, oldKey := newTestServerCertPEM(t)
+	writeKubeletSecret(t, dir, map[string][]byte{"tls.crt": oldCert, "tls.key": oldKey})
+	err = w.ensureCertsMounted(context.TODO(), secret)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrStaleMountedCerts))
+	assert.Contains(t, err.Error(), "tls.crt is different from secret test")
+
+	// the overall deadline
+	w.certOpt.MountCheckBackoff = &wait.Backoff{Duration: time.Millisecond * 10, Factor: 1, Steps: 1000}
+	w.certOpt.MountCheckTimeout = time.Millisecond * 100
+	start := time.Now()
+	err = w.ensureCertsMounted(context.TODO(), secret)
+	assert.True(t, errors.Is(err, ErrStaleMountedCerts))
+	assert.Less(t, time.Since(start), time.Second*5)
+
+	writeKubeletSecret(t, dir, map[string][]byte{"tls.crt": cert, "tls.key": key})
+	assert.NoError(t, w.ensureCertsMounted(context.TODO(), secret))
+
+	// the secret is renewed by other replica and its certs are mounted
+	newCert, newKey := newTestServerCertPEM(t)
+	secretClient.getSecret.Data = map[string][]byte{"tls.crt": newCert, "tls.key": newKey}
+	writeKubeletSecret(t, dir, map[string][]byte{"tls.crt": newCert, "tls.key": newKey})
+	assert.NoError(t, w.ensureCertsMounted(context.TODO(), secret))
+}
@@ -0,0 +1,60 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+
+	errors "golang.org/x/xerrors"
+)
+
+// InvalidCertReason is the reason why the certs in secret are invalid
+type InvalidCertReason string
+
+const (
+	// the data is missing in secret
+	CertMissing InvalidCertReason = "Missing"
+	// the data can not be parsed
+	CertMalformed InvalidCertReason = "Malformed"
+	// the cert is expired, not valid yet or will be expired within the renewal time
+	CertExpiring InvalidCertReason = "Expiring"
+	// the private key does not match the cert
+	CertKeyMismatch InvalidCertReason = "KeyMismatch"
+	// the cert is not issued by the CA in secret
+	CertNotIssuedByCA InvalidCertReason = "NotIssuedByCA"
+	// the key usages of the cert are not allowed for a server cert or a CA
+	CertKeyUsageInvalid InvalidCertReason = "KeyUsageInvalid"
+	// the hosts, subject or key parameters of the cert do not match CertOption
+	CertOptionsChanged InvalidCertReason = "OptionsChanged"
+	// the CA is replaced by ExternalCA or the Issuer
+	CertCAChanged InvalidCertReason = "CAChanged"
+)
+
+// InvalidCertError explains why the certs in secret are invalid, the certs are issued again for it
+type InvalidCertError struct {
+	// key of the invalid data in secret
+	Name   string
+	Reason InvalidCertReason
+	Err    error
+}
+
+func (e *InvalidCertError) Error() string {
+	return fmt.Sprintf("invalid %s (%s): %s", e.Name, e.Reason, e.Err)
+}
+
+func (e *InvalidCertError) Unwrap() error {
+	return e.Err
+}
+
+func newInvalidCertError(name string, reason InvalidCertReason, err error) error {
+	return &InvalidCertError{Name: name, Reason: reason, Err: err}
+}
+
+// keyMatchesCert checks whether key is the private key of cert
+func keyMatchesCert(key crypto.Signer, cert *x509.Certificate) error {
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return errors.New("private key does not match the cert")
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package cert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	errors "golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCertManager_certSecretIsValid_invalid_cert_error(t *testing.T) {
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt: CertOption{
+			Hosts:        []string{"example.com"},
+			CommonName:   "test",
+			KeyAlgorithm: ECDSAP256,
+		},
+	}
+	valid, err := c.newSecret()
+	assert.NoError(t, err)
+	assert.NoError(t, c.certSecretIsValid(valid, time.Now()))
+	ca, err := c.buildArtifactsFromSecret(valid)
+	assert.NoError(t, err)
+	other := newTestCA(t, nil)
+
+	tests := []struct {
+		name       string
+		tamper     func(t *testing.T, s *corev1.Secret)
+		wantName   string
+		wantReason InvalidCertReason
+	}{
+		{
+			name:       "missing server key",
+			tamper:     func(t *testing.T, s *corev1.Secret) { delete(s.Data, "tls.key") },
+			wantName:   "tls.key",
+			wantReason: CertMissing,
+		},
+		{
+			name:       "malformed server cert",
+			tamper:     func(t *testing.T, s *corev1.Secret) { s.Data["tls.crt"] = []byte("xxx") },
+			wantName:   "tls.crt",
+			wantReason: CertMalformed,
+		},
+		{
+			name:       "server key mismatch",
+			tamper:     func(t *testing.T, s *corev1.Secret) { s.Data["tls.key"] = other.keyPEM },
+			wantName:   "tls.key",
+			wantReason: CertKeyMismatch,
+		},
+		{
+			name:       "ca key mismatch",
+			tamper:     func(t *testing.T, s *corev1.Secret) { s.Data["ca.key"] = other.keyPEM },
+			wantName:   "ca.key",
+			wantReason: CertKeyMismatch,
+		},
+		{
+			name: "server cert issued by other ca",
+			tamper: func(t *testing.T, s *corev1.Secret) {
+				cert, key, err := c.createCertPEM(other, time.Now().Add(-time.Hour), time.Now().Add(time.Hour*24*365))
+				assert.NoError(t, err)
+				s.Data["tls.crt"], s.Data["tls.key"] = cert, key
+			},
+			wantName:   "tls.crt",
+			wantReason: CertNotIssuedByCA,
+		},
+		{
+			name: "server cert is a ca",
+			tamper: func(t *testing.T, s *corev1.Secret) {
+				s.Data["tls.crt"], s.Data["tls.key"] = other.certPEM, other.keyPEM
+			},
+			wantName:   "tls.crt",
+			wantReason: CertKeyUsageInvalid,
+		},
+		{
+			name: "expired server cert",
+			tamper: func(t *testing.T, s *corev1.Secret) {
+				cert, key, err := c.createCertPEM(ca, time.Now().Add(-time.Hour*2), time.Now().Add(-time.Hour))
+				assert.NoError(t, err)
+				s.Data["tls.crt"], s.Data["tls.key"] = cert, key
+			},
+			wantName:   "tls.crt",
+			wantReason: CertExpiring,
+		},
+		{
+			name: "hosts changed",
+			tamper: func(t *testing.T, s *corev1.Secret) {
+				opt := c.certOpt
+				opt.Hosts = []string{"other.example.com"}
+				cert, key, err := (&certManager{certOpt: opt}).createCertPEM(ca, time.Now().Add(-time.Hour), time.Now().Add(time.Hour*24*365))
+				assert.NoError(t, err)
+				s.Data["tls.crt"], s.Data["tls.key"] = cert, key
+			},
+			wantName:   "tls.crt",
+			wantReason: CertOptionsChanged,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := valid.DeepCopy()
+			tt.tamper(t, s)
+			err := c.certSecretIsValid(s, time.Now())
+			var invalidErr *InvalidCertError
+			if assert.True(t, errors.As(err, &invalidErr), "%v", err) {
+				assert.Equal(t, tt.wantName, invalidErr.Name)
+				assert.Equal(t, tt.wantReason, invalidErr.Reason)
+			}
+		})
+	}
+}
+
+func TestWebhookCert_CheckCertSecret(t *testing.T) {
+	certOpt := CertOption{
+		Hosts:        []string{"example.com"},
+		CommonName:   "test",
+		KeyAlgorithm: ECDSAP256,
+		SecretInfo:   SecretInfo{Name: "test"},
+	}
+	secretClient := &FakeSecretInterface{}
+	w := &WebhookCert{
+		certOpt: certOpt,
+		certmanager: &certManager{
+			secretInfo:   certOpt.SecretInfo,
+			certOpt:      certOpt,
+			secretClient: secretClient,
+		},
+	}
+	assert.Error(t, w.CheckCertSecret(context.TODO()))
+
+	_, err := w.certmanager.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, w.CheckCertSecret(context.TODO()))
+
+	secretClient.getSecret.Data["tls.key"] = newTestCA(t, nil).keyPEM
+	err = w.CheckCertSecret(context.TODO())
+	var invalidErr *InvalidCertError
+	assert.True(t, errors.As(err, &invalidErr))
+	assert.Equal(t, CertKeyMismatch, invalidErr.Reason)
+}
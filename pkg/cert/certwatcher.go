@@ -0,0 +1,160 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+	klog "k8s.io/klog/v2"
+)
+
+const certWatcherPollInterval = time.Second * 10
+
+// CertWatcher watches the server cert and key files and reloads them when they are changed,
+// e.g. the secret mounted to CertDir is rotated. the files are watched by inotify on Linux,
+// and they are also polled in case that some events are missed or inotify is not supported.
+type CertWatcher struct {
+	certFile string
+	keyFile  string
+	// poll the files at this interval, default: 10 seconds
+	PollInterval time.Duration
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	certPEM     []byte
+	keyPEM      []byte
+	reloadErr   error
+	subscribers []func(*tls.Certificate)
+	// watch the files in dir by inotify
+	watchDir func(ctx context.Context, dir string, events chan<- struct{}) error
+}
+
+// NewCertWatcher returns a CertWatcher of certFile and keyFile, the files are loaded at once
+func NewCertWatcher(certFile, keyFile string) (*CertWatcher, error) {
+	w := &CertWatcher{certFile: certFile, keyFile: keyFile, watchDir: watchDir}
+	if _, err := w.reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// CertWatcher returns a CertWatcher of the server cert in CertDir, it should be started by
+// CertWatcher.Start. CheckServerCertValid compares the served cert with the cert loaded by it
+// and reports the reload failure of it.
+func (w *WebhookCert) CertWatcher() (*CertWatcher, error) {
+	watcher, err := NewCertWatcher(w.certOpt.getServerCertPath(), w.certOpt.getServerKeyPath())
+	if err != nil {
+		return nil, err
+	}
+	w.certWatcherMu.Lock()
+	defer w.certWatcherMu.Unlock()
+	w.certWatcher = watcher
+	return watcher, nil
+}
+
+func (w *WebhookCert) getCertWatcher() *CertWatcher {
+	w.certWatcherMu.Lock()
+	defer w.certWatcherMu.Unlock()
+	return w.certWatcher
+}
+
+// GetCertificate returns the loaded server cert, it can be used as tls.Config.GetCertificate
+func (w *CertWatcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.cert, nil
+}
+
+// Subscribe registers fn which is called with the new server cert after it is reloaded
+func (w *CertWatcher) Subscribe(fn func(*tls.Certificate)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subscribers = append(w.subscribers, fn)
+}
+
+// ReloadError returns the error of the last reload, nil means the files are loaded.
+// the last loaded server cert is still served when the reload is failed
+func (w *CertWatcher) ReloadError() error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.reloadErr
+}
+
+// Start watches the files until ctx is done
+func (w *CertWatcher) Start(ctx context.Context) error {
+	events := make(chan struct{}, 1)
+	dirs := map[string]bool{filepath.Dir(w.certFile): true, filepath.Dir(w.keyFile): true}
+	for dir := range dirs {
+		if err := w.watchDir(ctx, dir, events); err != nil {
+			klog.Warningf("watch %s failed, will poll cert files: %s", dir, err)
+		}
+	}
+
+	interval := w.PollInterval
+	if interval <= 0 {
+		interval = certWatcherPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-events:
+		case <-ticker.C:
+		}
+		changed, err := w.reload()
+		if err != nil {
+			klog.Errorf("reload server cert failed: %s", err)
+			continue
+		}
+		if changed {
+			klog.Infof("reloaded server cert from %s", w.certFile)
+		}
+	}
+}
+
+// reload loads the files and replaces the server cert if they are changed,
+// the server cert is kept if the files can not be loaded
+func (w *CertWatcher) reload() (bool, error) {
+	certPem, keyPem, cert, err := w.load()
+	w.mu.Lock()
+	w.reloadErr = err
+	if err != nil {
+		w.mu.Unlock()
+		return false, err
+	}
+	if bytes.Equal(certPem, w.certPEM) && bytes.Equal(keyPem, w.keyPEM) {
+		w.mu.Unlock()
+		return false, nil
+	}
+	w.cert, w.certPEM, w.keyPEM = cert, certPem, keyPem
+	subscribers := append([]func(*tls.Certificate){}, w.subscribers...)
+	w.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(cert)
+	}
+	return true, nil
+}
+
+func (w *CertWatcher) load() ([]byte, []byte, *tls.Certificate, error) {
+	certPem, err := ioutil.ReadFile(w.certFile)
+	if err != nil {
+		return nil, nil, nil, errors.Errorf("read server cert: %w", err)
+	}
+	keyPem, err := ioutil.ReadFile(w.keyFile)
+	if err != nil {
+		return nil, nil, nil, errors.Errorf("read server key: %w", err)
+	}
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return nil, nil, nil, errors.Errorf("load server cert: %w", err)
+	}
+	return certPem, keyPem, &cert, nil
+}
@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package cert
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/sys/unix"
+	errors "golang.org/x/xerrors"
+)
+
+// watchDir sends to events when the files in dir are changed until ctx is done.
+// the secret mounted by kubelet is updated by replacing the ..data symlink in dir.
+func watchDir(ctx context.Context, dir string, events chan<- struct{}) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return errors.Errorf("init inotify: %w", err)
+	}
+	// the non-blocking fd is read by the runtime poller, so that Read returns when f is closed
+	f := os.NewFile(uintptr(fd), "inotify")
+	mask := uint32(unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+		unix.IN_CLOSE_WRITE | unix.IN_ATTRIB | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF)
+	if _, err := unix.InotifyAddWatch(fd, dir, mask); err != nil {
+		f.Close()
+		return errors.Errorf("add inotify watch: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go func() {
+		// events are only signals to reload, the rest of them are read by the next Read
+		buf := make([]byte, 8*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			if _, err := f.Read(buf); err != nil {
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package cert
+
+import (
+	"context"
+
+	errors "golang.org/x/xerrors"
+)
+
+// watchDir is only supported on Linux, the files are polled on other platforms
+func watchDir(ctx context.Context, dir string, events chan<- struct{}) error {
+	return errors.New("inotify is not supported")
+}
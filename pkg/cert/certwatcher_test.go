@@ -0,0 +1,164 @@
+package cert
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	errors "golang.org/x/xerrors"
+)
+
+func newTestServerCertPEM(t *testing.T) ([]byte, []byte) {
+	c := &certManager{certOpt: CertOption{Hosts: []string{"example.com"}, KeyAlgorithm: ECDSAP256}}
+	cert, key, err := c.createCertPEM(newTestCA(t, nil), time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	return cert, key
+}
+
+// writeKubeletSecret writes files like the secret volume of kubelet, the files are
+// symlinks to ..data which is replaced atomically on update
+func writeKubeletSecret(t *testing.T, dir string, files map[string][]byte) {
+	dataDir, err := ioutil.TempDir(dir, "..data_")
+	assert.NoError(t, err)
+	for name, data := range files {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dataDir, name), data, 0600))
+		if _, err := os.Lstat(path.Join(dir, name)); err != nil {
+			assert.NoError(t, os.Symlink(path.Join("..data", name), path.Join(dir, name)))
+		}
+	}
+	tmpLink := path.Join(dir, "..data_tmp")
+	assert.NoError(t, os.Symlink(path.Base(dataDir), tmpLink))
+	assert.NoError(t, os.Rename(tmpLink, path.Join(dir, "..data")))
+}
+
+func TestCertWatcher(t *testing.T) {
+	tests := []struct {
+		name         string
+		pollInterval time.Duration
+		noInotify    bool
+	}{
+		{name: "inotify", pollInterval: time.Hour},
+		{name: "poll", pollInterval: time.Millisecond * 50, noInotify: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cert, key := newTestServerCertPEM(t)
+			writeKubeletSecret(t, dir, map[string][]byte{"tls.crt": cert, "tls.key": key})
+			w, err := NewCertWatcher(path.Join(dir, "tls.crt"), path.Join(dir, "tls.key"))
+			assert.NoError(t, err)
+			w.PollInterval = tt.pollInterval
+			if tt.noInotify {
+				w.watchDir = func(ctx context.Context, dir string, events chan<- struct{}) error {
+					return errors.New("inotify is not supported")
+				}
+			}
+			got, err := w.GetCertificate(nil)
+			assert.NoError(t, err)
+			assert.Equal(t, decodePEMCerts(cert).Certificate, got.Certificate)
+
+			reloaded := make(chan *tls.Certificate, 10)
+			w.Subscribe(func(c *tls.Certificate) { reloaded <- c })
+			ctx, cancel := context.WithCancel(context.TODO())
+			defer cancel()
+			go w.Start(ctx)
+			time.Sleep(time.Millisecond * 100)
+
+			newCert, newKey := newTestServerCertPEM(t)
+			writeKubeletSecret(t, dir, map[string][]byte{"tls.crt": newCert, "tls.key": newKey})
+			select {
+			case c := <-reloaded:
+				assert.Equal(t, decodePEMCerts(newCert).Certificate, c.Certificate)
+			case <-time.After(time.Second * 5):
+				t.Fatal("server cert is not reloaded")
+			}
+			got, err = w.GetCertificate(nil)
+			assert.NoError(t, err)
+			assert.Equal(t, decodePEMCerts(newCert).Certificate, got.Certificate)
+			assert.NoError(t, w.ReloadError())
+
+			// the loaded server cert is kept when the files are broken
+			writeKubeletSecret(t, dir, map[string][]byte{"tls.crt": newCert, "tls.key": key})
+			assert.Eventually(t, func() bool { return w.ReloadError() != nil }, time.Second*5, time.Millisecond*10)
+			got, err = w.GetCertificate(nil)
+			assert.NoError(t, err)
+			assert.Equal(t, decodePEMCerts(newCert).Certificate, got.Certificate)
+		})
+	}
+}
+
+func TestWebhookCert_CheckServerCertValid_reload_failed(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := newTestServerCertPEM(t)
+	writeKubeletSecret(t, dir, map[string][]byte{"tls.crt": cert, "tls.key": key})
+	w := &WebhookCert{certOpt: CertOption{CertDir: dir}}
+	watcher, err := w.CertWatcher()
+	assert.NoError(t, err)
+
+	_, otherKey := newTestServerCertPEM(t)
+	writeKubeletSecret(t, dir, map[string][]byte{"tls.crt": cert, "tls.key": otherKey})
+	_, err = watcher.reload()
+	assert.Error(t, err)
+	err = w.CheckServerCertValid(context.TODO(), "127.0.0.1")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "reload server cert")
+}
+
+func TestWebhookCert_CertWatcher_concurrent(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := newTestServerCertPEM(t)
+	writeKubeletSecret(t, dir, map[string][]byte{"tls.crt": cert, "tls.key": key})
+	w := &WebhookCert{certOpt: CertOption{CertDir: dir}}
+
+	// CheckServerCertValid of probes reads the watcher while it is created
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			w.getCertWatcher()
+		}
+	}()
+	watcher, err := w.CertWatcher()
+	assert.NoError(t, err)
+	<-done
+	assert.Equal(t, watcher, w.getCertWatcher())
+}
+
+func TestWebhookCert_CheckServerCertValid_cert_watcher(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := newTestServerCertPEM(t)
+	writeKubeletSecret(t, dir, map[string][]byte{"tls.crt": cert, "tls.key": key})
+	w := &WebhookCert{
+		certOpt: CertOption{CertDir: dir},
+		checkerClient: &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		}},
+	}
+	watcher, err := w.CertWatcher()
+	assert.NoError(t, err)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	s.Listener = tls.NewListener(s.Listener, &tls.Config{GetCertificate: watcher.GetCertificate})
+	s.Start()
+	defer s.Close()
+	addr := s.Listener.Addr().String()
+	assert.NoError(t, w.CheckServerCertValid(context.TODO(), addr))
+
+	// the files are changed but not reloaded yet, the served cert is the loaded one
+	newCert, newKey := newTestServerCertPEM(t)
+	writeKubeletSecret(t, dir, map[string][]byte{"tls.crt": newCert, "tls.key": newKey})
+	assert.NoError(t, w.CheckServerCertValid(context.TODO(), addr))
+	changed, err := watcher.reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.NoError(t, w.CheckServerCertValid(context.TODO(), addr))
+}
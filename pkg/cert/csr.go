@@ -0,0 +1,178 @@
+package cert
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math"
+	"strings"
+	"time"
+
+	errors "golang.org/x/xerrors"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	csrTimeout      = time.Minute * 5
+	csrPollInterval = time.Second
+	// the apiserver rejects the CSRs whose expirationSeconds is less than 10 minutes
+	csrMinExpirationSeconds = 600
+)
+
+// CSRSigner issues the server cert by a signer of the cluster through
+// the certificates.k8s.io/v1 CertificateSigningRequest API instead of a self-generated CA.
+type CSRSigner struct {
+	// name of the signer, required. e.g. example.com/webhook-serving
+	SignerName string
+	// approve the CSR by webhookcert, the approve permission of the signer is required.
+	// default: wait for the CSR to be approved by others
+	AutoApprove bool
+	// PEM encoded CA certs of the signer, they are injected into caBundle.
+	// CACertPEM or CACertFile is required, the CA of the cluster is not guessed for any signer
+	CACertPEM []byte
+	// file of PEM encoded CA certs of the signer, used when CACertPEM is empty
+	CACertFile string
+	// wait for the cert to be issued until this timeout, default: 5 minutes
+	Timeout time.Duration
+}
+
+type csrInterface interface {
+	Create(ctx context.Context, csr *certificatesv1.CertificateSigningRequest, opts metav1.CreateOptions) (*certificatesv1.CertificateSigningRequest, error)
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*certificatesv1.CertificateSigningRequest, error)
+	UpdateApproval(ctx context.Context, name string, csr *certificatesv1.CertificateSigningRequest, opts metav1.UpdateOptions) (*certificatesv1.CertificateSigningRequest, error)
+}
+
+// csrIssuer is the Issuer of CSRSigner
+type csrIssuer struct {
+	signer    *CSRSigner
+	csrClient csrInterface
+	// prefix of the name of CSRs
+	namePrefix string
+}
+
+// Issue creates a CSR for the signer and waits for the cert to be issued
+func (i *csrIssuer) Issue(ctx context.Context, req *IssueRequest) (*IssuedCert, error) {
+	caPem, err := i.CABundle(ctx)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(req.CSR)
+	if block == nil {
+		return nil, errors.New("decode certificate request failed")
+	}
+	csrReq, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, errors.Errorf("while parsing certificate request: %w", err)
+	}
+	usages := []certificatesv1.KeyUsage{certificatesv1.UsageDigitalSignature, certificatesv1.UsageServerAuth}
+	if csrReq.PublicKeyAlgorithm == x509.RSA {
+		usages = append(usages, certificatesv1.UsageKeyEncipherment)
+	}
+	csr := &certificatesv1.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: i.namePrefix,
+		},
+		Spec: certificatesv1.CertificateSigningRequestSpec{
+			Request:    req.CSR,
+			SignerName: i.signer.SignerName,
+			Usages:     usages,
+		},
+	}
+	if req.Duration > 0 {
+		seconds := req.Duration / time.Second
+		if seconds > math.MaxInt32 {
+			seconds = math.MaxInt32
+		}
+		if seconds < csrMinExpirationSeconds {
+			seconds = csrMinExpirationSeconds
+		}
+		expirationSeconds := int32(seconds)
+		csr.Spec.ExpirationSeconds = &expirationSeconds
+	}
+
+	csr, err = i.csrClient.Create(ctx, csr, metav1.CreateOptions{})
+	if err != nil {
+		return nil, errors.Errorf("create csr: %w", err)
+	}
+	klog.Infof("created csr %s for signer %s", csr.Name, i.signer.SignerName)
+	if i.signer.AutoApprove && !csrHasCondition(csr, certificatesv1.CertificateApproved) {
+		csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
+			Type:           certificatesv1.CertificateApproved,
+			Status:         corev1.ConditionTrue,
+			Reason:         "WebhookCertApprove",
+			Message:        "approved by webhookcert",
+			LastUpdateTime: metav1.Now(),
+		})
+		if csr, err = i.csrClient.UpdateApproval(ctx, csr.Name, csr, metav1.UpdateOptions{}); err != nil {
+			return nil, errors.Errorf("approve csr: %w", err)
+		}
+	}
+
+	certPem, err := i.waitForCSRIssued(ctx, csr.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &IssuedCert{CertChainPEM: certPem, CABundlePEM: caPem}, nil
+}
+
+func (i *csrIssuer) waitForCSRIssued(ctx context.Context, name string) ([]byte, error) {
+	timeout := i.signer.Timeout
+	if timeout <= 0 {
+		timeout = csrTimeout
+	}
+	var certPem []byte
+	err := wait.PollUntilContextTimeout(ctx, csrPollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		csr, err := i.csrClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			klog.Warningf("get csr %s failed: %s", name, err)
+			return false, nil
+		}
+		for _, t := range []certificatesv1.RequestConditionType{certificatesv1.CertificateDenied, certificatesv1.CertificateFailed} {
+			if csrHasCondition(csr, t) {
+				return false, errors.Errorf("csr %s is %s", name, strings.ToLower(string(t)))
+			}
+		}
+		if len(csr.Status.Certificate) == 0 {
+			return false, nil
+		}
+		certPem = csr.Status.Certificate
+		return true, nil
+	})
+	if err != nil {
+		return nil, errors.Errorf("wait for csr %s to be issued: %w", name, err)
+	}
+	return certPem, nil
+}
+
+// CABundle returns the PEM encoded CA certs of the signer
+func (i *csrIssuer) CABundle(ctx context.Context) ([]byte, error) {
+	signer := i.signer
+	if signer.SignerName == "" {
+		return nil, errors.New("signer name is required")
+	}
+	if len(signer.CACertPEM) > 0 {
+		return signer.CACertPEM, nil
+	}
+	if signer.CACertFile != "" {
+		data, err := ioutil.ReadFile(signer.CACertFile)
+		if err != nil {
+			return nil, errors.Errorf("read CA cert: %w", err)
+		}
+		return data, nil
+	}
+	return nil, errors.Errorf("CACertPEM or CACertFile is required for signer %s", signer.SignerName)
+}
+
+func csrHasCondition(csr *certificatesv1.CertificateSigningRequest, t certificatesv1.RequestConditionType) bool {
+	for _, cond := range csr.Status.Conditions {
+		if cond.Type == t && cond.Status != corev1.ConditionFalse {
+			return true
+		}
+	}
+	return false
+}
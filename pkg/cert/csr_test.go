@@ -0,0 +1,218 @@
+package cert
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/mozillazg/pkiutil/pkg/decoder"
+	"github.com/mozillazg/pkiutil/pkg/encoder"
+	"github.com/stretchr/testify/assert"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newFakeSigner returns a clientset which signs the approved CSRs by ca
+func newFakeSigner(t *testing.T, ca *keyPairArtifacts, objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewSimpleClientset(objects...)
+	client.PrependReactor("update", "certificatesigningrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		csr := action.(k8stesting.UpdateAction).GetObject().(*certificatesv1.CertificateSigningRequest)
+		if action.GetSubresource() != "approval" || !csrHasCondition(csr, certificatesv1.CertificateApproved) {
+			return false, nil, nil
+		}
+		block, _ := pem.Decode(csr.Spec.Request)
+		req, err := x509.ParseCertificateRequest(block.Bytes)
+		assert.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      req.Subject,
+			DNSNames:     req.DNSNames,
+			IPAddresses:  req.IPAddresses,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Duration(*csr.Spec.ExpirationSeconds) * time.Second),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, req.PublicKey, ca.key)
+		assert.NoError(t, err)
+		csr.Status.Certificate, err = encoder.PemEncodeRawCerts([][]byte{der})
+		assert.NoError(t, err)
+		return false, nil, nil
+	})
+	return client
+}
+
+func TestCertManager_ensureSecret_csr_signer(t *testing.T) {
+	ca := newTestCA(t, nil)
+	client := newFakeSigner(t, ca)
+	secretClient := &FakeSecretInterface{}
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test", Namespace: "default"},
+		certOpt: CertOption{
+			Hosts:                      []string{"example.com", "127.0.0.1"},
+			CommonName:                 "test",
+			KeyAlgorithm:               ECDSAP256,
+			ServerCertValidityDuration: time.Hour * 24,
+			CSRSigner: &CSRSigner{
+				SignerName:  "example.com/webhook",
+				AutoApprove: true,
+				CACertPEM:   ca.certPEM,
+			},
+		},
+		secretClient: secretClient,
+		csrClient:    client.CertificatesV1().CertificateSigningRequests(),
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, s.Data, 3)
+	assert.Equal(t, ca.certPEM, s.Data["ca.crt"])
+	assert.NoError(t, c.certSecretIsValid(s, time.Now()))
+	serverCert, _, err := decoder.DecodePemCert(s.Data["tls.crt"])
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, serverCert.DNSNames)
+	assert.Len(t, serverCert.IPAddresses, 1)
+
+	csrs, err := client.CertificatesV1().CertificateSigningRequests().List(context.TODO(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, csrs.Items, 1)
+	csr := csrs.Items[0]
+	assert.Equal(t, "example.com/webhook", csr.Spec.SignerName)
+	assert.Equal(t, int32(24*60*60), *csr.Spec.ExpirationSeconds)
+	assert.True(t, csrHasCondition(&csr, certificatesv1.CertificateApproved))
+
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, s, newS)
+	assert.Equal(t, 0, secretClient.updates)
+
+	// request server cert again when CA of signer is changed
+	newCA := newTestCA(t, nil)
+	c.certOpt.CSRSigner.CACertPEM = newCA.certPEM
+	c.csrClient = newFakeSigner(t, newCA).CertificatesV1().CertificateSigningRequests()
+	newS, err = c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, newCA.certPEM, newS.Data["ca.crt"])
+	assert.NoError(t, c.certSecretIsValid(newS, time.Now()))
+	assert.Equal(t, 1, secretClient.updates)
+}
+
+func TestCertManager_ensureSecret_csr_signer_without_ca(t *testing.T) {
+	ca := newTestCA(t, nil)
+	client := newFakeSigner(t, ca, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-root-ca.crt", Namespace: "default"},
+		Data:       map[string]string{"ca.crt": string(ca.certPEM)},
+	})
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test", Namespace: "default"},
+		certOpt: CertOption{
+			Hosts:                      []string{"example.com", "127.0.0.1"},
+			CommonName:                 "test",
+			KeyAlgorithm:               ECDSAP256,
+			ServerCertValidityDuration: time.Hour * 24,
+			CSRSigner: &CSRSigner{
+				SignerName:  "kubernetes.io/kubelet-serving",
+				AutoApprove: true,
+			},
+		},
+		secretClient: &FakeSecretInterface{},
+		csrClient:    client.CertificatesV1().CertificateSigningRequests(),
+	}
+
+	// the CA of the cluster is not used even for kubernetes.io/ signers
+	_, err := c.ensureSecretWithoutRetry(context.TODO())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "CACertPEM or CACertFile is required for signer kubernetes.io/kubelet-serving")
+	csrs, err := client.CertificatesV1().CertificateSigningRequests().List(context.TODO(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, csrs.Items, 0)
+}
+
+func TestCSRIssuer_Issue_min_expiration(t *testing.T) {
+	ca := newTestCA(t, nil)
+	client := newFakeSigner(t, ca)
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test", Namespace: "default"},
+		certOpt: CertOption{
+			Hosts:                      []string{"example.com"},
+			CommonName:                 "test",
+			KeyAlgorithm:               ECDSAP256,
+			ServerCertValidityDuration: time.Minute,
+			CSRSigner: &CSRSigner{
+				SignerName:  "example.com/webhook",
+				AutoApprove: true,
+				CACertPEM:   ca.certPEM,
+			},
+		},
+		secretClient: &FakeSecretInterface{},
+		csrClient:    client.CertificatesV1().CertificateSigningRequests(),
+	}
+	_, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+
+	csrs, err := client.CertificatesV1().CertificateSigningRequests().List(context.TODO(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, csrs.Items, 1)
+	assert.Equal(t, int32(600), *csrs.Items[0].Spec.ExpirationSeconds)
+}
+
+func TestCSRIssuer_Issue_denied(t *testing.T) {
+	ca := newTestCA(t, nil)
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "certificatesigningrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		csr := action.(k8stesting.CreateAction).GetObject().(*certificatesv1.CertificateSigningRequest)
+		csr.Name = "test-denied"
+		csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
+			Type:   certificatesv1.CertificateDenied,
+			Status: corev1.ConditionTrue,
+		})
+		return false, nil, nil
+	})
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test", Namespace: "default"},
+		certOpt: CertOption{
+			Hosts:                      []string{"example.com", "127.0.0.1"},
+			CommonName:                 "test",
+			KeyAlgorithm:               ECDSAP256,
+			ServerCertValidityDuration: time.Hour * 24,
+			CSRSigner: &CSRSigner{
+				SignerName: "example.com/webhook",
+				CACertPEM:  ca.certPEM,
+				Timeout:    time.Second * 3,
+			},
+		},
+		secretClient: &FakeSecretInterface{},
+		csrClient:    client.CertificatesV1().CertificateSigningRequests(),
+	}
+	err := c.issueServerCertByIssuer(context.TODO(), c.issuer(), &corev1.Secret{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "csr test-denied is denied")
+}
+
+func TestCertManager_ensureSecret_csr_signer_with_external_ca(t *testing.T) {
+	ca := newTestCA(t, nil)
+	client := fake.NewSimpleClientset()
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test", Namespace: "default"},
+		certOpt: CertOption{
+			Hosts:                      []string{"example.com", "127.0.0.1"},
+			CommonName:                 "test",
+			KeyAlgorithm:               ECDSAP256,
+			ServerCertValidityDuration: time.Hour * 24,
+			CSRSigner:                  &CSRSigner{SignerName: "example.com/webhook"},
+		},
+		secretClient: &FakeSecretInterface{},
+		csrClient:    client.CertificatesV1().CertificateSigningRequests(),
+	}
+	c.certOpt.ExternalCA = &ExternalCA{CertPEM: ca.certPEM, KeyPEM: ca.keyPEM}
+	_, err := c.ensureSecretWithoutRetry(context.TODO())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "only one of ExternalCA, CSRSigner and Issuer")
+}
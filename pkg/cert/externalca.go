@@ -0,0 +1,165 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"io/ioutil"
+
+	"github.com/mozillazg/pkiutil/pkg/decoder"
+	"github.com/mozillazg/pkiutil/pkg/encoder"
+	errors "golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// ExternalCA is an existing CA which is used to issue the server cert instead of a self-generated CA,
+// the CA is never regenerated or rotated by webhookcert. Only one of the sources should be set.
+type ExternalCA struct {
+	// PEM encoded CA cert and key, the CA cert can be followed by the certs of its chain,
+	// e.g. the cert of an intermediate CA followed by the cert of the root CA
+	CertPEM []byte
+	KeyPEM  []byte
+	// files of PEM encoded CA cert and key
+	CertFile string
+	KeyFile  string
+	// secret of CA cert and key, CACertName and CAKeyName of it are used as the keys,
+	// default namespace: CertOption.SecretInfo.Namespace
+	Secret SecretInfo
+}
+
+func (e *ExternalCA) validate() error {
+	sources := 0
+	if len(e.CertPEM) > 0 || len(e.KeyPEM) > 0 {
+		sources++
+	}
+	if e.CertFile != "" || e.KeyFile != "" {
+		sources++
+	}
+	if e.Secret.Name != "" {
+		sources++
+	}
+	if sources != 1 {
+		return errors.New("exactly one of CertPEM/KeyPEM, CertFile/KeyFile and Secret should be set for external CA")
+	}
+	return nil
+}
+
+// loadExternalCA loads the external CA, chainPEM of it contains the certs in the CA's chain
+// except the self-signed root CA, they are appended to the server cert.
+func (c *certManager) loadExternalCA(ctx context.Context) (*keyPairArtifacts, error) {
+	e := c.certOpt.ExternalCA
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+	certPem, keyPem := e.CertPEM, e.KeyPEM
+	switch {
+	case e.CertFile != "" || e.KeyFile != "":
+		var err error
+		if certPem, err = ioutil.ReadFile(e.CertFile); err != nil {
+			return nil, errors.Errorf("read CA cert: %w", err)
+		}
+		if keyPem, err = ioutil.ReadFile(e.KeyFile); err != nil {
+			return nil, errors.Errorf("read CA key: %w", err)
+		}
+	case e.Secret.Name != "":
+		secret, err := c.externalCASecretClient.Get(ctx, e.Secret.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Errorf("get secret %s: %w", e.Secret.Name, err)
+		}
+		var ok bool
+		if certPem, ok = secret.Data[e.Secret.getCACertName()]; !ok {
+			return nil, errors.Errorf("secret %s is not well-formed, missing %s", e.Secret.Name, e.Secret.getCACertName())
+		}
+		if keyPem, ok = secret.Data[e.Secret.getCAKeyName()]; !ok {
+			return nil, errors.Errorf("secret %s is not well-formed, missing %s", e.Secret.Name, e.Secret.getCAKeyName())
+		}
+	}
+
+	certs, err := decoder.DecodePemCerts(bytes.TrimSpace(certPem))
+	if err != nil {
+		return nil, errors.Errorf("while parsing CA cert: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("while parsing CA cert: no cert is found")
+	}
+	key, err := decodePrivateKeyPEM(keyPem)
+	if err != nil {
+		return nil, errors.Errorf("while parsing CA key: %w", err)
+	}
+	cert := certs[0]
+	if !cert.IsCA {
+		return nil, errors.New("external CA cert is not a CA")
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(cert.PublicKey) {
+		return nil, errors.New("external CA key does not match CA cert")
+	}
+
+	var chain [][]byte
+	for _, x := range certs {
+		if !isSelfSigned(x) {
+			chain = append(chain, x.Raw)
+		}
+	}
+	chainPem, err := encoder.PemEncodeRawCerts(chain)
+	if err != nil {
+		return nil, errors.Errorf("encoding PEM: %w", err)
+	}
+	return &keyPairArtifacts{cert: cert, key: key, certPEM: certPem, keyPEM: keyPem, chainPEM: chainPem}, nil
+}
+
+// ensureSecretWithExternalCA issues the server cert by the external CA,
+// the server cert is re-issued when it is expiring or the external CA is changed.
+func (c *certManager) ensureSecretWithExternalCA(ctx context.Context) (*corev1.Secret, error) {
+	name := c.secretInfo.Name
+	ca, err := c.loadExternalCA(ctx)
+	if err != nil {
+		return nil, errors.Errorf("load external ca: %w", err)
+	}
+	now := c.now()
+	if err := certIsValid(ca.cert, now, 0); err != nil {
+		return nil, errors.Errorf("external ca: %w", err)
+	}
+	if err := certIsValid(ca.cert, now, c.certOpt.getRenewBefore(ca.cert)); err != nil {
+		klog.Warningf("external ca will be expired, it should be renewed: %s", err)
+	}
+
+	secret, err := c.getSecret(ctx)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, errors.Errorf("get secret %s: %w", name, err)
+		}
+		klog.Warningf("secret %s is not found, will create secret", name)
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: c.secretInfo.Namespace,
+			},
+			Data: map[string][]byte{},
+		}
+		if err := c.issueServerCert(secret, ca); err != nil {
+			return nil, errors.Errorf("new server cert: %w", err)
+		}
+		return c.createSecret(ctx, secret)
+	}
+
+	err = c.serverCertIsValid(secret, now)
+	if err == nil {
+		err = c.verifyServerCertChain(secret, now)
+	}
+	if err == nil && !bytes.Equal(secret.Data[c.secretInfo.getCACertName()], ca.certPEM) {
+		err = newInvalidCertError(c.secretInfo.getCACertName(), CertCAChanged, errors.New("external ca is changed"))
+	}
+	if err == nil {
+		klog.Infof("use exist secret %s", name)
+		return secret, nil
+	}
+	klog.Warningf("parse server cert from secret %s failed, will renew server cert: %s", name, err)
+	if err := c.issueServerCert(secret, ca); err != nil {
+		return nil, errors.Errorf("new server cert: %w", err)
+	}
+	c.removeSelfGeneratedCA(secret)
+	return c.updateSecret(ctx, secret)
+}
@@ -0,0 +1,194 @@
+package cert
+
+import (
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mozillazg/pkiutil/pkg/decoder"
+	"github.com/mozillazg/pkiutil/pkg/encoder"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func newTestCA(t *testing.T, parent *keyPairArtifacts) *keyPairArtifacts {
+	key, err := generatePrivateKey(ECDSAP256, 0)
+	assert.NoError(t, err)
+	opt := certTemplateOption{
+		commonName: "root",
+		notBefore:  time.Now().Add(-time.Hour),
+		notAfter:   time.Now().Add(time.Hour * 24 * 365),
+		isCA:       true,
+	}
+	if parent != nil {
+		opt.commonName = "intermediate"
+		opt.parentCert = parent.cert
+		opt.parentKey = parent.key
+	}
+	cert, err := generateCert(opt, key)
+	assert.NoError(t, err)
+	certPem, err := encoder.PemEncodeCert(cert)
+	assert.NoError(t, err)
+	keyPem, err := encodePrivateKeyPEM(key)
+	assert.NoError(t, err)
+	return &keyPairArtifacts{cert: cert, key: key, certPEM: certPem, keyPEM: keyPem}
+}
+
+func TestCertManager_ensureSecret_external_ca(t *testing.T) {
+	root := newTestCA(t, nil)
+	secretClient := &FakeSecretInterface{}
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt: CertOption{
+			Hosts:      []string{"example.com"},
+			CommonName: "test",
+			ExternalCA: &ExternalCA{CertPEM: root.certPEM, KeyPEM: root.keyPEM},
+		},
+		secretClient: secretClient,
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, s.Data, 3)
+	assert.Equal(t, root.certPEM, s.Data["ca.crt"])
+	assert.Nil(t, s.Data["ca.key"])
+	assert.NoError(t, c.certSecretIsValid(s, time.Now()))
+
+	// root CA is not included in the server cert
+	certs, err := decoder.DecodePemCerts(s.Data["tls.crt"])
+	assert.NoError(t, err)
+	assert.Len(t, certs, 1)
+	assert.NoError(t, certs[0].CheckSignatureFrom(root.cert))
+
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, s, newS)
+	assert.Equal(t, 0, secretClient.updates)
+
+	// renew server cert when external CA is changed
+	newRoot := newTestCA(t, nil)
+	c.certOpt.ExternalCA = &ExternalCA{CertPEM: newRoot.certPEM, KeyPEM: newRoot.keyPEM}
+	newS, err = c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, newRoot.certPEM, newS.Data["ca.crt"])
+	serverCert, _, err := decoder.DecodePemCert(newS.Data["tls.crt"])
+	assert.NoError(t, err)
+	assert.NoError(t, serverCert.CheckSignatureFrom(newRoot.cert))
+	assert.Equal(t, 1, secretClient.updates)
+}
+
+func TestCertManager_ensureSecret_external_intermediate_ca(t *testing.T) {
+	root := newTestCA(t, nil)
+	intermediate := newTestCA(t, root)
+	caPem := appendPEM(intermediate.certPEM, root.certPEM)
+
+	dir := t.TempDir()
+	certFile, keyFile := path.Join(dir, "ca.crt"), path.Join(dir, "ca.key")
+	assert.NoError(t, ioutil.WriteFile(certFile, caPem, 0644))
+	assert.NoError(t, ioutil.WriteFile(keyFile, intermediate.keyPEM, 0600))
+
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt: CertOption{
+			Hosts:      []string{"example.com"},
+			CommonName: "test",
+			ExternalCA: &ExternalCA{CertFile: certFile, KeyFile: keyFile},
+		},
+		secretClient: &FakeSecretInterface{},
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, caPem, s.Data["ca.crt"])
+
+	// the server cert is followed by the intermediate CA
+	certs, err := decoder.DecodePemCerts(s.Data["tls.crt"])
+	assert.NoError(t, err)
+	assert.Len(t, certs, 2)
+	assert.Equal(t, intermediate.cert.Raw, certs[1].Raw)
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(certs[1])
+	_, err = certs[0].Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots, Intermediates: intermediates})
+	assert.NoError(t, err)
+}
+
+func TestCertManager_ensureSecret_external_ca_from_secret(t *testing.T) {
+	root := newTestCA(t, nil)
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt: CertOption{
+			Hosts:      []string{"example.com"},
+			CommonName: "test",
+			ExternalCA: &ExternalCA{
+				Secret: SecretInfo{Name: "org-ca", CACertName: "tls.crt", CAKeyName: "tls.key"},
+			},
+		},
+		secretClient: &FakeSecretInterface{},
+	}
+	c.externalCASecretClient = &FakeSecretInterface{getSecret: &corev1.Secret{
+		Data: map[string][]byte{"tls.crt": root.certPEM, "tls.key": root.keyPEM},
+	}}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, root.certPEM, s.Data["ca.crt"])
+
+	c.externalCASecretClient = &FakeSecretInterface{getSecret: &corev1.Secret{
+		Data: map[string][]byte{"tls.crt": root.certPEM},
+	}}
+	_, err = c.loadExternalCA(context.TODO())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "missing tls.key")
+}
+
+func TestCertManager_loadExternalCA_invalid(t *testing.T) {
+	root := newTestCA(t, nil)
+	other := newTestCA(t, nil)
+	server, _, err := (&certManager{}).createCertPEM(root, time.Now(), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		externalCA *ExternalCA
+		err        string
+	}{
+		{
+			name:       "no source",
+			externalCA: &ExternalCA{},
+			err:        "exactly one of",
+		},
+		{
+			name:       "multiple sources",
+			externalCA: &ExternalCA{CertPEM: root.certPEM, KeyPEM: root.keyPEM, CertFile: "ca.crt"},
+			err:        "exactly one of",
+		},
+		{
+			name:       "key mismatch",
+			externalCA: &ExternalCA{CertPEM: root.certPEM, KeyPEM: other.keyPEM},
+			err:        "does not match",
+		},
+		{
+			name:       "not ca",
+			externalCA: &ExternalCA{CertPEM: server, KeyPEM: root.keyPEM},
+			err:        "is not a CA",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &certManager{
+				secretInfo: SecretInfo{Name: "test"},
+				certOpt: CertOption{
+					Hosts:      []string{"example.com"},
+					CommonName: "test",
+					ExternalCA: tt.externalCA,
+				},
+				secretClient: &FakeSecretInterface{},
+			}
+			_, err := c.loadExternalCA(context.TODO())
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"strings"
+	"time"
+
+	"github.com/mozillazg/pkiutil/pkg/decoder"
+	"github.com/mozillazg/pkiutil/pkg/encoder"
+	errors "golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// With CertOption.IntermediateCA, the root CA only signs an intermediate CA, and the intermediate CA
+// issues the server cert. The intermediate CA has the same lifetime as the root CA, it is
+// saved to secret and appended to the server cert.
+const (
+	intermediateCACertName = "ca-intermediate.crt"
+	intermediateCAKeyName  = "ca-intermediate.key"
+)
+
+// ensureIntermediateCA returns the intermediate CA signed by root in secret,
+// a new intermediate CA is created and saved to secret if it is not valid.
+func (c *certManager) ensureIntermediateCA(secret *corev1.Secret, root *keyPairArtifacts) (*keyPairArtifacts, error) {
+	now := c.now()
+	ca, err := c.intermediateCAFromSecret(secret, root, now)
+	if err == nil {
+		return ca, nil
+	}
+	klog.Warningf("intermediate ca is not ready, will create intermediate ca: %s", err)
+	if root.key == nil {
+		return nil, errors.New("ca key is required to create intermediate ca")
+	}
+	ca, err = c.createCA(c.intermediateCACommonName(), root, now.Add(-1*time.Hour), root.cert.NotAfter)
+	if err != nil {
+		return nil, errors.Errorf("create intermediate ca cert: %w", err)
+	}
+	ca.chainPEM = ca.certPEM
+	secret.Data[intermediateCACertName] = ca.certPEM
+	if c.saveCAKey() {
+		if err := c.setCAKey(secret, intermediateCAKeyName, ca.keyPEM); err != nil {
+			return nil, err
+		}
+	}
+	return ca, nil
+}
+
+func (c *certManager) intermediateCAFromSecret(secret *corev1.Secret, root *keyPairArtifacts, now time.Time) (*keyPairArtifacts, error) {
+	certPem, ok := secret.Data[intermediateCACertName]
+	if !ok {
+		return nil, errors.Errorf("missing %s", intermediateCACertName)
+	}
+	keyPem, ok := secret.Data[intermediateCAKeyName]
+	if !ok {
+		return nil, errors.Errorf("missing %s", intermediateCAKeyName)
+	}
+	keyPem, err := c.decryptCAKey(intermediateCAKeyName, keyPem)
+	if err != nil {
+		return nil, err
+	}
+	cert, _, err := decoder.DecodePemCert(certPem)
+	if err != nil {
+		return nil, errors.Errorf("while parsing intermediate CA cert: %w", err)
+	}
+	key, err := decodePrivateKeyPEM(keyPem)
+	if err != nil {
+		return nil, errors.Errorf("while parsing intermediate CA key: %w", err)
+	}
+	if err := cert.CheckSignatureFrom(root.cert); err != nil {
+		return nil, errors.Errorf("intermediate CA is not signed by current ca: %w", err)
+	}
+	if err := certIsValid(cert, now, c.certOpt.getRenewBefore(cert)); err != nil {
+		return nil, err
+	}
+	if err := c.caCertMatchesOption(cert, c.intermediateCACommonName()); err != nil {
+		return nil, err
+	}
+	return &keyPairArtifacts{cert: cert, key: key, certPEM: certPem, keyPEM: keyPem, chainPEM: certPem}, nil
+}
+
+func (c *certManager) intermediateCACommonName() string {
+	return strings.TrimSpace(c.certOpt.CAName + " Intermediate CA")
+}
+
+// rootCAPEM returns the self-signed root CA certs in pemCerts,
+// pemCerts is returned as it is if there is no root CA cert in it
+func rootCAPEM(pemCerts []byte) []byte {
+	certs, err := decoder.DecodePemCerts(bytes.TrimSpace(pemCerts))
+	if err != nil {
+		return pemCerts
+	}
+	var roots [][]byte
+	for _, cert := range certs {
+		if isSelfSigned(cert) {
+			roots = append(roots, cert.Raw)
+		}
+	}
+	if len(roots) == 0 || len(roots) == len(certs) {
+		return pemCerts
+	}
+	data, err := encoder.PemEncodeRawCerts(roots)
+	if err != nil {
+		return pemCerts
+	}
+	return data
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
@@ -0,0 +1,106 @@
+package cert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mozillazg/pkiutil/pkg/decoder"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertManager_ensureSecret_intermediate_ca(t *testing.T) {
+	secretClient := &FakeSecretInterface{}
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt: CertOption{
+			CAName:         "ca",
+			Hosts:          []string{"example.com"},
+			CommonName:     "test",
+			KeyAlgorithm:   ECDSAP256,
+			IntermediateCA: true,
+		},
+		secretClient: secretClient,
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, c.certSecretIsValid(s, time.Now()))
+
+	certs, err := decoder.DecodePemCerts(s.Data["tls.crt"])
+	assert.NoError(t, err)
+	assert.Len(t, certs, 2)
+	intermediate, _, err := decoder.DecodePemCert(s.Data["ca-intermediate.crt"])
+	assert.NoError(t, err)
+	assert.Equal(t, "ca Intermediate CA", intermediate.Subject.CommonName)
+	assert.Equal(t, intermediate.Raw, certs[1].Raw)
+	assert.NotEmpty(t, s.Data["ca-intermediate.key"])
+
+	// only root CA is injected into caBundle
+	trusted, _ := c.caBundle(s, time.Now())
+	assert.Equal(t, s.Data["ca.crt"], trusted)
+	root, _, err := decoder.DecodePemCert(trusted)
+	assert.NoError(t, err)
+	assert.True(t, root.IsCA)
+	assert.NoError(t, intermediate.CheckSignatureFrom(root))
+
+	// server cert is renewed by the same intermediate CA
+	ca, err := c.buildArtifactsFromSecret(s)
+	assert.NoError(t, err)
+	expiredCert, expiredKey, err := c.createCertPEM(ca, time.Now().Add(-time.Hour*2), time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	secretClient.getSecret.Data["tls.crt"] = expiredCert
+	secretClient.getSecret.Data["tls.key"] = expiredKey
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, c.certSecretIsValid(newS, time.Now()))
+	assert.Equal(t, s.Data["ca-intermediate.crt"], newS.Data["ca-intermediate.crt"])
+	assert.NotEqual(t, s.Data["tls.crt"], newS.Data["tls.crt"])
+
+	// intermediate CA which is not signed by current CA is replaced
+	other := newTestCA(t, nil)
+	otherIntermediate := newTestCA(t, other)
+	secretClient.getSecret.Data["ca-intermediate.crt"] = otherIntermediate.certPEM
+	secretClient.getSecret.Data["ca-intermediate.key"] = otherIntermediate.keyPEM
+	secretClient.getSecret.Data["tls.crt"] = expiredCert
+	newS, err = c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, c.certSecretIsValid(newS, time.Now()))
+	assert.NotEqual(t, otherIntermediate.certPEM, newS.Data["ca-intermediate.crt"])
+}
+
+func TestCertManager_certSecretIsValid_broken_chain(t *testing.T) {
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt: CertOption{
+			CAName:         "ca",
+			Hosts:          []string{"example.com"},
+			CommonName:     "test",
+			KeyAlgorithm:   ECDSAP256,
+			IntermediateCA: true,
+		},
+		secretClient: &FakeSecretInterface{},
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+
+	// the intermediate CA is missing in the server cert
+	serverCert, _, err := decoder.DecodePemCert(s.Data["tls.crt"])
+	assert.NoError(t, err)
+	s.Data["tls.crt"] = s.Data["tls.crt"][:len(s.Data["tls.crt"])-len(s.Data["ca-intermediate.crt"])]
+	leaf, _, err := decoder.DecodePemCert(s.Data["tls.crt"])
+	assert.NoError(t, err)
+	assert.Equal(t, serverCert.Raw, leaf.Raw)
+	err = c.certSecretIsValid(s, time.Now())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not issued by current ca")
+}
+
+func Test_rootCAPEM(t *testing.T) {
+	root := newTestCA(t, nil)
+	intermediate := newTestCA(t, root)
+
+	assert.Equal(t, root.certPEM, rootCAPEM(appendPEM(intermediate.certPEM, root.certPEM)))
+	assert.Equal(t, root.certPEM, rootCAPEM(root.certPEM))
+	assert.Equal(t, intermediate.certPEM, rootCAPEM(intermediate.certPEM))
+	assert.Equal(t, []byte("invalid"), rootCAPEM([]byte("invalid")))
+}
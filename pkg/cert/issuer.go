@@ -0,0 +1,186 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"time"
+
+	"github.com/mozillazg/pkiutil/pkg/decoder"
+	errors "golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// Issuer issues the server cert by an external CA, e.g. Vault PKI or a KMS-backed signer.
+// The private key of the server cert is generated by webhookcert and never sent to the Issuer.
+type Issuer interface {
+	// Issue signs the certificate request
+	Issue(ctx context.Context, req *IssueRequest) (*IssuedCert, error)
+}
+
+// CABundleGetter can be implemented by an Issuer to report the CA certs without issuing a cert,
+// the server cert is issued again when the CA certs are changed.
+type CABundleGetter interface {
+	// CABundle returns the PEM encoded CA certs which are injected into caBundle
+	CABundle(ctx context.Context) ([]byte, error)
+}
+
+type IssueRequest struct {
+	// PEM encoded certificate request which is signed by the private key of the server cert
+	CSR []byte
+	// the parsed fields of CSR
+	CommonName    string
+	Organizations []string
+	DNSNames      []string
+	IPAddresses   []net.IP
+	// requested lifetime of the server cert, 0 means the default of the Issuer
+	Duration time.Duration
+}
+
+type IssuedCert struct {
+	// PEM encoded server cert, it can be followed by the certs of its chain
+	CertChainPEM []byte
+	// PEM encoded CA certs which are injected into caBundle
+	CABundlePEM []byte
+}
+
+// issuer returns the Issuer of the server cert, nil means the server cert is issued by a CA in memory
+func (c *certManager) issuer() Issuer {
+	if c.certOpt.Issuer != nil {
+		return c.certOpt.Issuer
+	}
+	if c.certOpt.CSRSigner != nil {
+		return &csrIssuer{
+			signer:     c.certOpt.CSRSigner,
+			csrClient:  c.csrClient,
+			namePrefix: c.secretInfo.Name + "-",
+		}
+	}
+	return nil
+}
+
+// ensureSecretWithIssuer issues the server cert by issuer, the server cert is
+// issued again when it is expiring or the CA certs of issuer are changed.
+func (c *certManager) ensureSecretWithIssuer(ctx context.Context, issuer Issuer) (*corev1.Secret, error) {
+	name := c.secretInfo.Name
+	var caPem []byte
+	if getter, ok := issuer.(CABundleGetter); ok {
+		var err error
+		if caPem, err = getter.CABundle(ctx); err != nil {
+			return nil, errors.Errorf("get ca bundle of issuer: %w", err)
+		}
+	}
+
+	secret, err := c.getSecret(ctx)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, errors.Errorf("get secret %s: %w", name, err)
+		}
+		klog.Warningf("secret %s is not found, will create secret", name)
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: c.secretInfo.Namespace,
+			},
+			Data: map[string][]byte{},
+		}
+		if err := c.issueServerCertByIssuer(ctx, issuer, secret); err != nil {
+			return nil, errors.Errorf("issue server cert: %w", err)
+		}
+		return c.createSecret(ctx, secret)
+	}
+
+	now := c.now()
+	if caPem != nil && !bytes.Equal(secret.Data[c.secretInfo.getCACertName()], caPem) {
+		err = newInvalidCertError(c.secretInfo.getCACertName(), CertCAChanged, errors.New("ca of issuer is changed"))
+	} else if err = c.serverCertIsValid(secret, now); err == nil {
+		err = c.verifyServerCertChain(secret, now)
+	}
+	if err == nil {
+		klog.Infof("use exist secret %s", name)
+		return secret, nil
+	}
+	klog.Warningf("parse server cert from secret %s failed, will issue server cert: %s", name, err)
+	if err := c.issueServerCertByIssuer(ctx, issuer, secret); err != nil {
+		return nil, errors.Errorf("issue server cert: %w", err)
+	}
+	return c.updateSecret(ctx, secret)
+}
+
+// issueServerCertByIssuer issues a new server cert by issuer and saves it to secret
+func (c *certManager) issueServerCertByIssuer(ctx context.Context, issuer Issuer, secret *corev1.Secret) error {
+	key, err := generatePrivateKey(c.certOpt.KeyAlgorithm, c.certOpt.getRSAKeySize())
+	if err != nil {
+		return errors.Errorf("generating key: %w", err)
+	}
+	req, err := c.newIssueRequest(key)
+	if err != nil {
+		return err
+	}
+	issued, err := issuer.Issue(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	leaf, _, err := decoder.DecodePemCert(bytes.TrimSpace(issued.CertChainPEM))
+	if err != nil {
+		return errors.Errorf("while parsing issued cert: %w", err)
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(leaf.PublicKey) {
+		return errors.New("issued cert does not match the requested key")
+	}
+	if len(issued.CABundlePEM) == 0 {
+		return errors.New("issuer returns no CA cert")
+	}
+	// the chain is verified again on the next check, the cert would be issued on every check if it is not valid
+	if err := c.verifyServerCertChain(&corev1.Secret{Data: map[string][]byte{
+		c.secretInfo.getCACertName(): issued.CABundlePEM,
+		c.secretInfo.getCertName():   issued.CertChainPEM,
+	}}, c.now()); err != nil {
+		return errors.Errorf("issued cert is not valid for the CA bundle of issuer: %w", err)
+	}
+	keyPem, err := encodePrivateKeyPEM(key)
+	if err != nil {
+		return errors.Errorf("encoding PEM: %w", err)
+	}
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	secret.Data[c.secretInfo.getCACertName()] = issued.CABundlePEM
+	secret.Data[c.secretInfo.getCertName()] = issued.CertChainPEM
+	secret.Data[c.secretInfo.getKeyName()] = keyPem
+	c.removeSelfGeneratedCA(secret)
+	return nil
+}
+
+func (c *certManager) newIssueRequest(key crypto.Signer) (*IssueRequest, error) {
+	req := &IssueRequest{
+		CommonName:    c.certOpt.CommonName,
+		Organizations: c.certOpt.getOrganizations(),
+	}
+	req.DNSNames, req.IPAddresses = splitHosts(c.certOpt.getHots())
+	if c.certOpt.ServerCertValidityDuration > 0 || c.certOpt.CertValidityDuration > 0 {
+		req.Duration = c.certOpt.getServerCertValidityDuration()
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   req.CommonName,
+			Organization: req.Organizations,
+		},
+		DNSNames:    req.DNSNames,
+		IPAddresses: req.IPAddresses,
+	}, key)
+	if err != nil {
+		return nil, errors.Errorf("create certificate request: %w", err)
+	}
+	req.CSR = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	return req, nil
+}
@@ -0,0 +1,199 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mozillazg/pkiutil/pkg/decoder"
+	"github.com/mozillazg/pkiutil/pkg/encoder"
+	"github.com/stretchr/testify/assert"
+	errors "golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// httpIssuer is an Issuer which works like the sign API of Vault PKI
+type httpIssuer struct {
+	url string
+}
+
+type httpIssuerRequest struct {
+	CSR string `json:"csr"`
+	TTL string `json:"ttl"`
+}
+
+type httpIssuerResponse struct {
+	Certificate string   `json:"certificate"`
+	IssuingCA   string   `json:"issuing_ca"`
+	CAChain     []string `json:"ca_chain"`
+}
+
+func (i *httpIssuer) Issue(ctx context.Context, req *IssueRequest) (*IssuedCert, error) {
+	body, _ := json.Marshal(httpIssuerRequest{CSR: string(req.CSR), TTL: req.Duration.String()})
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, i.url+"/v1/pki/sign/webhook", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	var data httpIssuerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	issued := &IssuedCert{CertChainPEM: []byte(data.Certificate)}
+	issued.CertChainPEM = appendPEM(issued.CertChainPEM, []byte(data.IssuingCA))
+	for _, c := range data.CAChain[1:] {
+		issued.CABundlePEM = appendPEM(issued.CABundlePEM, []byte(c))
+	}
+	return issued, nil
+}
+
+// newHTTPIssuerServer returns a server which signs CSRs by the intermediate CA of root
+func newHTTPIssuerServer(t *testing.T, root, intermediate *keyPairArtifacts) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req httpIssuerRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		ttl, err := time.ParseDuration(req.TTL)
+		assert.NoError(t, err)
+		if ttl == 0 {
+			ttl = time.Hour * 24 * 30
+		}
+		block, _ := pem.Decode([]byte(req.CSR))
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil || csr.CheckSignature() != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			IPAddresses:  csr.IPAddresses,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(ttl),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, intermediate.cert, csr.PublicKey, intermediate.key)
+		assert.NoError(t, err)
+		certPem, err := encoder.PemEncodeRawCerts([][]byte{der})
+		assert.NoError(t, err)
+		_ = json.NewEncoder(w).Encode(httpIssuerResponse{
+			Certificate: string(certPem),
+			IssuingCA:   string(intermediate.certPEM),
+			CAChain:     []string{string(intermediate.certPEM), string(root.certPEM)},
+		})
+	}))
+}
+
+func TestCertManager_ensureSecret_issuer(t *testing.T) {
+	root := newTestCA(t, nil)
+	intermediate := newTestCA(t, root)
+	server := newHTTPIssuerServer(t, root, intermediate)
+	defer server.Close()
+
+	secretClient := &FakeSecretInterface{}
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt: CertOption{
+			Hosts:                      []string{"example.com"},
+			CommonName:                 "test",
+			ServerCertValidityDuration: time.Hour * 24,
+			Issuer:                     &httpIssuer{url: server.URL},
+		},
+		secretClient: secretClient,
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, s.Data, 3)
+	assert.Equal(t, root.certPEM, s.Data["ca.crt"])
+	assert.NoError(t, c.certSecretIsValid(s, time.Now()))
+	certs, err := decoder.DecodePemCerts(s.Data["tls.crt"])
+	assert.NoError(t, err)
+	assert.Len(t, certs, 2)
+	assert.WithinDuration(t, time.Now().Add(time.Hour*24), certs[0].NotAfter, time.Minute)
+	assert.Equal(t, intermediate.cert.Raw, certs[1].Raw)
+
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, s, newS)
+	assert.Equal(t, 0, secretClient.updates)
+
+	// issue server cert again when it is expiring
+	c.certOpt.RenewBeforePercentage = 99
+	newS, err = c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.NotEqual(t, s.Data["tls.crt"], newS.Data["tls.crt"])
+	assert.Equal(t, 1, secretClient.updates)
+}
+
+type fakeIssuer struct {
+	issued *IssuedCert
+}
+
+func (f *fakeIssuer) Issue(ctx context.Context, req *IssueRequest) (*IssuedCert, error) {
+	return f.issued, nil
+}
+
+func TestCertManager_issueServerCertByIssuer_invalid(t *testing.T) {
+	ca := newTestCA(t, nil)
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt:    CertOption{Hosts: []string{"example.com"}, CommonName: "test", KeyAlgorithm: ECDSAP256},
+	}
+	other, _, err := c.createCertPEM(ca, time.Now(), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+
+	err = c.issueServerCertByIssuer(context.TODO(), &fakeIssuer{
+		issued: &IssuedCert{CertChainPEM: other, CABundlePEM: ca.certPEM},
+	}, &corev1.Secret{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match the requested key")
+
+	err = c.issueServerCertByIssuer(context.TODO(), &fakeIssuer{
+		issued: &IssuedCert{CertChainPEM: []byte("invalid")},
+	}, &corev1.Secret{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "while parsing issued cert")
+}
+
+func TestCertManager_ensureSecret_issuer_ca_bundle_mismatch(t *testing.T) {
+	ca := newTestCA(t, nil)
+	client := newFakeSigner(t, ca)
+	secretClient := &FakeSecretInterface{}
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test", Namespace: "default"},
+		certOpt: CertOption{
+			Hosts:                      []string{"example.com"},
+			CommonName:                 "test",
+			KeyAlgorithm:               ECDSAP256,
+			ServerCertValidityDuration: time.Hour * 24,
+			CSRSigner: &CSRSigner{
+				SignerName:  "example.com/webhook",
+				AutoApprove: true,
+				CACertPEM:   newTestCA(t, nil).certPEM,
+			},
+		},
+		secretClient: secretClient,
+		csrClient:    client.CertificatesV1().CertificateSigningRequests(),
+	}
+
+	// the cert is not saved, otherwise it is issued again on every check
+	_, err := c.ensureSecretWithoutRetry(context.TODO())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not valid for the CA bundle of issuer")
+	assert.Nil(t, secretClient.getSecret)
+}
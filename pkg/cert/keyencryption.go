@@ -0,0 +1,264 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	errors "golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The CA private keys are encrypted by envelope encryption when CertOption.CAKeyEncryption is set:
+// every key is encrypted with AES-GCM by a random data key, and the data key is wrapped by
+// the KeyWrapper and saved next to the encrypted key in a PEM block.
+const (
+	encryptedKeyPEMType = "WEBHOOKCERT ENCRYPTED PRIVATE KEY"
+	wrappedKeyPEMHeader = "Wrapped-Key"
+	dataKeySize         = 32
+)
+
+// KeyWrapper wraps the data keys which encrypt the CA private keys, e.g. by a KMS
+type KeyWrapper interface {
+	WrapKey(key []byte) ([]byte, error)
+	UnwrapKey(wrappedKey []byte) ([]byte, error)
+}
+
+// CAKeyEncryption encrypts the CA private keys saved to secret, only one of the fields can be set.
+// the keys saved before the encryption is enabled are encrypted on the next check.
+type CAKeyEncryption struct {
+	// file of the key encryption key, base64 encoded AES key of 16, 24 or 32 bytes.
+	// e.g. generated by `head -c 32 /dev/urandom | base64`
+	KeyFile string
+	// name of the env var of the key encryption key, base64 encoded AES key of 16, 24 or 32 bytes
+	KeyEnv string
+	// custom KeyWrapper, e.g. a KMS
+	KeyWrapper KeyWrapper
+}
+
+// caKeyDecryptError is returned when a CA key can not be decrypted,
+// the CA is not regenerated for it, otherwise a wrong key encryption key would replace the CA
+type caKeyDecryptError struct {
+	name string
+	err  error
+}
+
+func (e *caKeyDecryptError) Error() string {
+	return fmt.Sprintf("decrypt %s: %s", e.name, e.err)
+}
+
+func (e *caKeyDecryptError) Unwrap() error {
+	return e.err
+}
+
+type aesKeyWrapper struct {
+	aead cipher.AEAD
+}
+
+// NewAESKeyWrapper returns a KeyWrapper which wraps data keys with AES-GCM by key,
+// key must be 16, 24 or 32 bytes
+func NewAESKeyWrapper(key []byte) (KeyWrapper, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aesKeyWrapper{aead: aead}, nil
+}
+
+func (w *aesKeyWrapper) WrapKey(key []byte) ([]byte, error) {
+	return seal(w.aead, key)
+}
+
+func (w *aesKeyWrapper) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	return open(w.aead, wrappedKey)
+}
+
+func (e *CAKeyEncryption) keyWrapper() (KeyWrapper, error) {
+	n := 0
+	for _, set := range []bool{e.KeyFile != "", e.KeyEnv != "", e.KeyWrapper != nil} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, errors.New("exactly one of KeyFile, KeyEnv and KeyWrapper of CAKeyEncryption must be set")
+	}
+	if e.KeyWrapper != nil {
+		return e.KeyWrapper, nil
+	}
+
+	var encoded []byte
+	if e.KeyFile != "" {
+		data, err := ioutil.ReadFile(e.KeyFile)
+		if err != nil {
+			return nil, errors.Errorf("read key encryption key: %w", err)
+		}
+		encoded = data
+	} else {
+		v, ok := os.LookupEnv(e.KeyEnv)
+		if !ok {
+			return nil, errors.Errorf("env %s of key encryption key is not set", e.KeyEnv)
+		}
+		encoded = []byte(v)
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+	if err != nil {
+		return nil, errors.Errorf("key encryption key is not base64 encoded: %w", err)
+	}
+	return NewAESKeyWrapper(key)
+}
+
+// caKeyWrapper returns the KeyWrapper of CertOption.CAKeyEncryption, nil means CA keys are not encrypted
+func (c *certManager) caKeyWrapper() (KeyWrapper, error) {
+	if c.certOpt.CAKeyEncryption == nil {
+		return nil, nil
+	}
+	return c.certOpt.CAKeyEncryption.keyWrapper()
+}
+
+// encryptCAKey encrypts the PEM encoded key, keyPem is returned as it is if CA keys are not encrypted
+func (c *certManager) encryptCAKey(keyPem []byte) ([]byte, error) {
+	wrapper, err := c.caKeyWrapper()
+	if err != nil || wrapper == nil {
+		return keyPem, err
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, errors.Errorf("generate data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := seal(aead, keyPem)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := wrapper.WrapKey(dataKey)
+	if err != nil {
+		return nil, errors.Errorf("wrap data key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    encryptedKeyPEMType,
+		Headers: map[string]string{wrappedKeyPEMHeader: base64.StdEncoding.EncodeToString(wrappedKey)},
+		Bytes:   encrypted,
+	}), nil
+}
+
+// decryptCAKey returns the PEM encoded key saved as name in secret, the key which is not encrypted
+// is returned as it is, so that the keys saved before the encryption is enabled can be used
+func (c *certManager) decryptCAKey(name string, data []byte) ([]byte, error) {
+	if !isEncryptedKeyPEM(data) {
+		return data, nil
+	}
+	keyPem, err := c.decryptCAKeyPEM(data)
+	if err != nil {
+		return nil, &caKeyDecryptError{name: name, err: err}
+	}
+	return keyPem, nil
+}
+
+func (c *certManager) decryptCAKeyPEM(data []byte) ([]byte, error) {
+	wrapper, err := c.caKeyWrapper()
+	if err != nil {
+		return nil, err
+	}
+	if wrapper == nil {
+		return nil, errors.New("key is encrypted but CAKeyEncryption is not set")
+	}
+	block, _ := pem.Decode(data)
+	wrappedKey, err := base64.StdEncoding.DecodeString(block.Headers[wrappedKeyPEMHeader])
+	if err != nil || len(wrappedKey) == 0 {
+		return nil, errors.Errorf("invalid %s header", wrappedKeyPEMHeader)
+	}
+	dataKey, err := wrapper.UnwrapKey(wrappedKey)
+	if err != nil {
+		return nil, errors.Errorf("unwrap data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, block.Bytes)
+}
+
+// setCAKey saves the PEM encoded key as name in secret, the saved data is kept if it is
+// the same key, so that secret is not changed when the key is not changed
+func (c *certManager) setCAKey(secret *corev1.Secret, name string, keyPem []byte) error {
+	if old, ok := secret.Data[name]; ok && isEncryptedKeyPEM(old) == (c.certOpt.CAKeyEncryption != nil) {
+		if oldKeyPem, err := c.decryptCAKey(name, old); err == nil && bytes.Equal(oldKeyPem, keyPem) {
+			return nil
+		}
+	}
+	data, err := c.encryptCAKey(keyPem)
+	if err != nil {
+		return errors.Errorf("encrypt %s: %w", name, err)
+	}
+	secret.Data[name] = data
+	return nil
+}
+
+// encryptCAKeys encrypts the CA keys in secret which are not encrypted,
+// it returns false if secret is not changed
+func (c *certManager) encryptCAKeys(secret *corev1.Secret) (bool, error) {
+	if c.certOpt.CAKeyEncryption == nil {
+		return false, nil
+	}
+	changed := false
+	for _, name := range []string{c.secretInfo.getCAKeyName(), nextCAKeyName, intermediateCAKeyName} {
+		keyPem, ok := secret.Data[name]
+		if !ok || isEncryptedKeyPEM(keyPem) {
+			continue
+		}
+		if err := c.setCAKey(secret, name, keyPem); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+func isEncryptedKeyPEM(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == encryptedKeyPEMType
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Errorf("invalid AES key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Errorf("create gcm: %w", err)
+	}
+	return aead, nil
+}
+
+// seal encrypts plaintext with a random nonce, the nonce is prepended to the result
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Errorf("generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.Errorf("decrypt: %w", err)
+	}
+	return plaintext, nil
+}
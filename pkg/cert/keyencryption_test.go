@@ -0,0 +1,159 @@
+package cert
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertManager_ensureSecret_ca_key_encryption(t *testing.T) {
+	t.Setenv("TEST_CA_KEY_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	secretClient := &FakeSecretInterface{}
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt: CertOption{
+			Hosts:           []string{"example.com"},
+			CommonName:      "test",
+			KeyAlgorithm:    ECDSAP256,
+			IntermediateCA:  true,
+			CAKeyEncryption: &CAKeyEncryption{KeyEnv: "TEST_CA_KEY_ENCRYPTION_KEY"},
+		},
+		secretClient: secretClient,
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, c.certSecretIsValid(s, time.Now()))
+	for _, name := range []string{"ca.key", intermediateCAKeyName} {
+		assert.True(t, isEncryptedKeyPEM(secretClient.getSecret.Data[name]), name)
+		_, err := decodePrivateKeyPEM(secretClient.getSecret.Data[name])
+		assert.Error(t, err)
+	}
+	ca, err := c.buildArtifactsFromSecret(s)
+	assert.NoError(t, err)
+	assert.NotNil(t, ca.key)
+
+	// encrypted keys are not changed when the server cert is renewed
+	assert.NoError(t, c.issueServerCert(s, ca))
+	assert.Equal(t, secretClient.getSecret.Data["ca.key"], s.Data["ca.key"])
+	assert.Equal(t, secretClient.getSecret.Data[intermediateCAKeyName], s.Data[intermediateCAKeyName])
+
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, secretClient.getSecret.Data, newS.Data)
+	assert.Equal(t, 0, secretClient.updates)
+}
+
+func TestCertManager_ensureSecret_encrypt_existing_ca_key(t *testing.T) {
+	secretClient := &FakeSecretInterface{}
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt: CertOption{
+			Hosts:           []string{"example.com"},
+			CommonName:      "test",
+			KeyAlgorithm:    ECDSAP256,
+			IntermediateCA:  true,
+			CAKeyEncryption: nil,
+		},
+		secretClient: secretClient,
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.False(t, isEncryptedKeyPEM(s.Data["ca.key"]))
+
+	dir := t.TempDir()
+	keyFile := path.Join(dir, "kek")
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(make([]byte, 16))+"\n"), 0600))
+	c.certOpt.CAKeyEncryption = &CAKeyEncryption{KeyFile: keyFile}
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, secretClient.updates)
+	assert.Equal(t, s.Data["ca.crt"], newS.Data["ca.crt"])
+	assert.Equal(t, s.Data["tls.crt"], newS.Data["tls.crt"])
+	for _, name := range []string{"ca.key", intermediateCAKeyName} {
+		assert.True(t, isEncryptedKeyPEM(newS.Data[name]), name)
+		keyPem, err := c.decryptCAKey(name, newS.Data[name])
+		assert.NoError(t, err)
+		assert.Equal(t, s.Data[name], keyPem)
+	}
+}
+
+func TestCertManager_ensureSecret_decrypt_ca_key_failed(t *testing.T) {
+	wrapper, err := NewAESKeyWrapper(make([]byte, 32))
+	assert.NoError(t, err)
+	secretClient := &FakeSecretInterface{}
+	c := &certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt: CertOption{
+			Hosts:           []string{"example.com"},
+			CommonName:      "test",
+			KeyAlgorithm:    ECDSAP256,
+			IntermediateCA:  true,
+			CAKeyEncryption: &CAKeyEncryption{KeyWrapper: wrapper},
+		},
+		secretClient: secretClient,
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+
+	// the CA is not replaced when the CA key can not be decrypted
+	otherKey := make([]byte, 32)
+	otherKey[0] = 1
+	c.certOpt.CAKeyEncryption.KeyWrapper, err = NewAESKeyWrapper(otherKey)
+	assert.NoError(t, err)
+	_, err = c.ensureSecretWithoutRetry(context.TODO())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "decrypt ca.key")
+
+	c.certOpt.CAKeyEncryption = nil
+	_, err = c.ensureSecretWithoutRetry(context.TODO())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "CAKeyEncryption is not set")
+	assert.Equal(t, 0, secretClient.updates)
+	assert.Equal(t, s.Data, secretClient.getSecret.Data)
+}
+
+func TestCAKeyEncryption_keyWrapper_invalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption *CAKeyEncryption
+		err        string
+	}{
+		{
+			name:       "no source",
+			encryption: &CAKeyEncryption{},
+			err:        "exactly one of",
+		},
+		{
+			name:       "multiple sources",
+			encryption: &CAKeyEncryption{KeyFile: "kek", KeyEnv: "KEK"},
+			err:        "exactly one of",
+		},
+		{
+			name:       "env not set",
+			encryption: &CAKeyEncryption{KeyEnv: "TEST_CA_KEY_ENCRYPTION_KEY_NOT_SET"},
+			err:        "is not set",
+		},
+		{
+			name:       "missing file",
+			encryption: &CAKeyEncryption{KeyFile: path.Join(t.TempDir(), "kek")},
+			err:        "read key encryption key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.encryption.keyWrapper()
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+
+	t.Setenv("TEST_CA_KEY_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 10)))
+	_, err := (&CAKeyEncryption{KeyEnv: "TEST_CA_KEY_ENCRYPTION_KEY"}).keyWrapper()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid AES key")
+}
@@ -0,0 +1,224 @@
+package cert
+
+import (
+	"context"
+	"os"
+	"time"
+
+	errors "golang.org/x/xerrors"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	issueLeaseDuration = time.Second * 30
+	issueLeaseRetry    = time.Second * 2
+	// release the Lease within this timeout, other replicas take it after it is expired otherwise
+	issueLeaseReleaseTimeout = time.Second * 10
+)
+
+// IssueLease is a coordination.k8s.io Lease which is held by the replica that checks and issues
+// certs, so that replicas starting at the same time do not issue certs at once.
+type IssueLease struct {
+	// name of the Lease, required
+	Name string
+	// namespace of the Lease, default: SecretInfo.Namespace
+	Namespace string
+	// identity of the replica, default: hostname
+	Identity string
+	// other replicas can take the Lease if it is not renewed within this duration,
+	// it is saved in seconds and must be at least 1 second. default: 30 seconds
+	LeaseDuration time.Duration
+}
+
+type leaseInterface interface {
+	Create(ctx context.Context, lease *coordinationv1.Lease, opts metav1.CreateOptions) (*coordinationv1.Lease, error)
+	Update(ctx context.Context, lease *coordinationv1.Lease, opts metav1.UpdateOptions) (*coordinationv1.Lease, error)
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*coordinationv1.Lease, error)
+}
+
+// leaseLock holds an IssueLease, the Lease is renewed until it is released
+type leaseLock struct {
+	info     IssueLease
+	client   leaseInterface
+	identity string
+	now      func() time.Time
+
+	lease *coordinationv1.Lease
+	stop  context.CancelFunc
+	done  chan struct{}
+}
+
+func newLeaseLock(info IssueLease, client leaseInterface, now func() time.Time) (*leaseLock, error) {
+	if info.Name == "" {
+		return nil, errors.New("name of IssueLease is required")
+	}
+	if info.LeaseDuration > 0 && info.LeaseDuration < time.Second {
+		return nil, errors.Errorf("LeaseDuration of IssueLease %s must be at least 1 second", info.Name)
+	}
+	identity := info.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, errors.Errorf("get hostname: %w", err)
+		}
+		identity = hostname
+	}
+	return &leaseLock{info: info, client: client, identity: identity, now: now}, nil
+}
+
+// withIssueLease calls fn while CertOption.IssueLease is held, fn is called at once if it is not set
+func (c *certManager) withIssueLease(ctx context.Context, fn func() error) error {
+	if c.certOpt.IssueLease == nil {
+		return fn()
+	}
+	lock, err := newLeaseLock(*c.certOpt.IssueLease, c.leaseClient, c.now)
+	if err != nil {
+		return err
+	}
+	if err := lock.acquire(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), issueLeaseReleaseTimeout)
+		defer cancel()
+		lock.release(ctx)
+	}()
+	return fn()
+}
+
+func (l *leaseLock) duration() time.Duration {
+	if l.info.LeaseDuration > 0 {
+		return l.info.LeaseDuration
+	}
+	return issueLeaseDuration
+}
+
+// acquire waits until the Lease is acquired or ctx is done
+func (l *leaseLock) acquire(ctx context.Context) error {
+	err := wait.PollUntilContextCancel(ctx, issueLeaseRetry, true, func(ctx context.Context) (bool, error) {
+		acquired, err := l.tryAcquire(ctx)
+		if err != nil {
+			klog.Warningf("acquire lease %s failed: %s", l.info.Name, err)
+			return false, nil
+		}
+		if !acquired {
+			klog.Infof("lease %s is held by %s, waiting for it", l.info.Name, l.holder())
+		}
+		return acquired, nil
+	})
+	if err != nil {
+		return errors.Errorf("acquire lease %s: %w", l.info.Name, err)
+	}
+	klog.Infof("acquired lease %s", l.info.Name)
+
+	renewCtx, stop := context.WithCancel(context.Background())
+	l.stop = stop
+	l.done = make(chan struct{})
+	go l.renew(renewCtx)
+	return nil
+}
+
+// tryAcquire takes the Lease if it is free, expired or held by us
+func (l *leaseLock) tryAcquire(ctx context.Context) (bool, error) {
+	now := metav1.NewMicroTime(l.now())
+	seconds := int32(l.duration() / time.Second)
+	lease, err := l.client.Get(ctx, l.info.Name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return false, err
+		}
+		lease, err = l.client.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: l.info.Name},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		l.lease = lease
+		return true, nil
+	}
+
+	l.lease = lease
+	if holder := l.holder(); holder != "" && holder != l.identity && !l.expired(lease) {
+		return false, nil
+	}
+	lease = lease.DeepCopy()
+	lease.Spec.HolderIdentity = &l.identity
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	// fail with conflict if other replicas take the Lease at the same time
+	lease, err = l.client.Update(ctx, lease, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	l.lease = lease
+	return true, nil
+}
+
+func (l *leaseLock) holder() string {
+	if l.lease == nil || l.lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *l.lease.Spec.HolderIdentity
+}
+
+func (l *leaseLock) expired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expireAt := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return !l.now().Before(expireAt)
+}
+
+func (l *leaseLock) renew(ctx context.Context) {
+	defer close(l.done)
+	ticker := time.NewTicker(l.duration() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		lease := l.lease.DeepCopy()
+		now := metav1.NewMicroTime(l.now())
+		lease.Spec.RenewTime = &now
+		renewed, err := l.client.Update(ctx, lease, metav1.UpdateOptions{})
+		if err != nil {
+			klog.Warningf("renew lease %s failed: %s", l.info.Name, err)
+			continue
+		}
+		l.lease = renewed
+	}
+}
+
+// release stops renewing the Lease and frees it for other replicas
+func (l *leaseLock) release(ctx context.Context) {
+	l.stop()
+	<-l.done
+	lease := l.lease.DeepCopy()
+	lease.Spec.HolderIdentity = nil
+	lease.Spec.AcquireTime = nil
+	lease.Spec.RenewTime = nil
+	if _, err := l.client.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		klog.Warningf("release lease %s failed: %s", l.info.Name, err)
+		return
+	}
+	klog.Infof("released lease %s", l.info.Name)
+}
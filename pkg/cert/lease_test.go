@@ -0,0 +1,101 @@
+package cert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func TestLeaseLock(t *testing.T) {
+	clock := testingclock.NewFakePassiveClock(time.Now())
+	client := fake.NewSimpleClientset().CoordinationV1().Leases("default")
+	info := IssueLease{Name: "webhookcert", LeaseDuration: time.Minute}
+	a, err := newLeaseLock(IssueLease{Name: info.Name, Identity: "a", LeaseDuration: info.LeaseDuration}, client, clock.Now)
+	assert.NoError(t, err)
+	b, err := newLeaseLock(IssueLease{Name: info.Name, Identity: "b", LeaseDuration: info.LeaseDuration}, client, clock.Now)
+	assert.NoError(t, err)
+
+	assert.NoError(t, a.acquire(context.TODO()))
+	acquired, err := b.tryAcquire(context.TODO())
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	assert.Equal(t, "a", b.holder())
+
+	// wait for the lease until ctx is done
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Millisecond*100)
+	defer cancel()
+	assert.Error(t, b.acquire(ctx))
+
+	a.release(context.TODO())
+	lease, err := client.Get(context.TODO(), info.Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, lease.Spec.HolderIdentity)
+	assert.NoError(t, b.acquire(context.TODO()))
+
+	// the lease which is not renewed can be taken by others
+	b.stop()
+	<-b.done
+	clock.SetTime(clock.Now().Add(time.Minute))
+	acquired, err = a.tryAcquire(context.TODO())
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, "a", a.holder())
+}
+
+func TestLeaseLock_min_duration(t *testing.T) {
+	client := fake.NewSimpleClientset().CoordinationV1().Leases("default")
+	_, err := newLeaseLock(IssueLease{Name: "webhookcert", LeaseDuration: time.Millisecond * 500}, client, time.Now)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "must be at least 1 second")
+
+	_, err = newLeaseLock(IssueLease{Name: "webhookcert", LeaseDuration: time.Second}, client, time.Now)
+	assert.NoError(t, err)
+}
+
+func TestWebhookCert_ensureCert_issue_lease(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	secretClient := &FakeSecretInterface{}
+	certOpt := CertOption{
+		Hosts:        []string{"example.com"},
+		CommonName:   "test",
+		KeyAlgorithm: ECDSAP256,
+		SecretInfo:   SecretInfo{Name: "test"},
+		IssueLease:   &IssueLease{Name: "webhookcert", Identity: "a"},
+	}
+	w := &WebhookCert{
+		certOpt: certOpt,
+		certmanager: &certManager{
+			secretInfo:   certOpt.SecretInfo,
+			certOpt:      certOpt,
+			secretClient: secretClient,
+			leaseClient:  client.CoordinationV1().Leases("default"),
+		},
+		webhookmanager: &webhookManager{},
+	}
+	s, err := w.ensureCert(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, w.certmanager.certSecretIsValid(s, time.Now()))
+	lease, err := client.CoordinationV1().Leases("default").Get(context.TODO(), "webhookcert", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, lease.Spec.HolderIdentity)
+
+	// wait for the lease which is held by other replica
+	_, err = client.CoordinationV1().Leases("default").Update(context.TODO(), func() *coordinationv1.Lease {
+		holder := "b"
+		now := metav1.NewMicroTime(time.Now())
+		lease.Spec.HolderIdentity, lease.Spec.RenewTime = &holder, &now
+		return lease
+	}(), metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Millisecond*100)
+	defer cancel()
+	_, err = w.ensureCert(ctx)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "acquire lease webhookcert")
+}
@@ -0,0 +1,194 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mozillazg/pkiutil/pkg/encoder"
+	errors "golang.org/x/xerrors"
+)
+
+type KeyAlgorithm string
+
+const (
+	RSA       KeyAlgorithm = "RSA"
+	ECDSAP256 KeyAlgorithm = "ECDSAP256"
+	ECDSAP384 KeyAlgorithm = "ECDSAP384"
+	Ed25519   KeyAlgorithm = "Ed25519"
+)
+
+type certTemplateOption struct {
+	commonName    string
+	organizations []string
+	hosts         []string
+	notBefore     time.Time
+	notAfter      time.Time
+	isCA          bool
+
+	// sign with this cert and key, self-signed if nil
+	parentCert *x509.Certificate
+	parentKey  crypto.Signer
+}
+
+func generatePrivateKey(alg KeyAlgorithm, rsaKeySize int) (crypto.Signer, error) {
+	switch alg {
+	case "", RSA:
+		return rsa.GenerateKey(rand.Reader, rsaKeySize)
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	return nil, errors.Errorf("unknown key algorithm: %s", alg)
+}
+
+func generateCert(opt certTemplateOption, key crypto.Signer) (*x509.Certificate, error) {
+	serialNum, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Errorf("generate serial number: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNum,
+		Subject: pkix.Name{
+			CommonName:   opt.commonName,
+			Organization: opt.organizations,
+		},
+		NotBefore:             opt.notBefore,
+		NotAfter:              opt.notAfter,
+		BasicConstraintsValid: true,
+	}
+	template.DNSNames, template.IPAddresses = splitHosts(opt.hosts)
+
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	// key encipherment only makes sense for RSA keys
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	if opt.isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.IsCA = true
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+
+	parentCert := opt.parentCert
+	parentKey := opt.parentKey
+	if parentCert == nil || parentKey == nil {
+		parentCert = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, key.Public(), parentKey)
+	if err != nil {
+		return nil, errors.Errorf("create certificate: %w", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// splitHosts splits hosts to DNS names and IP addresses
+func splitHosts(hosts []string) (dnsNames []string, ips []net.IP) {
+	for _, h := range hosts {
+		h := strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		dnsNames = append(dnsNames, h)
+	}
+	return dnsNames, ips
+}
+
+// publicKeyMatches checks whether pub is a key of alg, rsaKeySize is only used when alg is RSA
+func publicKeyMatches(pub crypto.PublicKey, alg KeyAlgorithm, rsaKeySize int) error {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if algName(alg) != RSA {
+			return errors.Errorf("key algorithm is %s, want %s", RSA, alg)
+		}
+		if k.N.BitLen() != rsaKeySize {
+			return errors.Errorf("RSA key size is %d, want %d", k.N.BitLen(), rsaKeySize)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		want := map[KeyAlgorithm]elliptic.Curve{ECDSAP256: elliptic.P256(), ECDSAP384: elliptic.P384()}[alg]
+		if want == nil || k.Curve != want {
+			return errors.Errorf("key algorithm is ECDSA %s, want %s", k.Curve.Params().Name, algName(alg))
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != Ed25519 {
+			return errors.Errorf("key algorithm is %s, want %s", Ed25519, algName(alg))
+		}
+		return nil
+	}
+	return errors.Errorf("unsupported public key type: %T", pub)
+}
+
+func algName(alg KeyAlgorithm) KeyAlgorithm {
+	if alg == "" {
+		return RSA
+	}
+	return alg
+}
+
+func encodePrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		// keep PKCS#1 for compatibility with secrets created by old versions
+		return encoder.PemEncodePrivateKey(k)
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, errors.Errorf("marshal ecdsa key: %w", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, errors.Errorf("marshal key: %w", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+}
+
+func decodePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("decode private key failed: bad key")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Errorf("parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported private key type: %T", key)
+	}
+	return signer, nil
+}
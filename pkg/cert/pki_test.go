@@ -0,0 +1,143 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_generatePrivateKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		alg     KeyAlgorithm
+		check   func(t *testing.T, key interface{})
+		wantErr bool
+	}{
+		{
+			name: "default",
+			alg:  "",
+			check: func(t *testing.T, key interface{}) {
+				k, ok := key.(*rsa.PrivateKey)
+				assert.True(t, ok)
+				assert.Equal(t, 2048, k.N.BitLen())
+			},
+		},
+		{
+			name: "rsa",
+			alg:  RSA,
+			check: func(t *testing.T, key interface{}) {
+				_, ok := key.(*rsa.PrivateKey)
+				assert.True(t, ok)
+			},
+		},
+		{
+			name: "ecdsa p256",
+			alg:  ECDSAP256,
+			check: func(t *testing.T, key interface{}) {
+				k, ok := key.(*ecdsa.PrivateKey)
+				assert.True(t, ok)
+				assert.Equal(t, elliptic.P256(), k.Curve)
+			},
+		},
+		{
+			name: "ecdsa p384",
+			alg:  ECDSAP384,
+			check: func(t *testing.T, key interface{}) {
+				k, ok := key.(*ecdsa.PrivateKey)
+				assert.True(t, ok)
+				assert.Equal(t, elliptic.P384(), k.Curve)
+			},
+		},
+		{
+			name: "ed25519",
+			alg:  Ed25519,
+			check: func(t *testing.T, key interface{}) {
+				_, ok := key.(ed25519.PrivateKey)
+				assert.True(t, ok)
+			},
+		},
+		{
+			name:    "unknown",
+			alg:     "DSA",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := generatePrivateKey(tt.alg, rsaKeySize)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			tt.check(t, key)
+
+			keyPem, err := encodePrivateKeyPEM(key)
+			assert.NoError(t, err)
+			decoded, err := decodePrivateKeyPEM(keyPem)
+			assert.NoError(t, err)
+			assert.Equal(t, key.Public(), decoded.Public())
+		})
+	}
+}
+
+func Test_generateCert(t *testing.T) {
+	for _, alg := range []KeyAlgorithm{RSA, ECDSAP256, ECDSAP384, Ed25519} {
+		t.Run(string(alg), func(t *testing.T) {
+			now := time.Now()
+			caKey, err := generatePrivateKey(alg, rsaKeySize)
+			assert.NoError(t, err)
+			ca, err := generateCert(certTemplateOption{
+				commonName: "ca",
+				notBefore:  now.Add(-time.Hour),
+				notAfter:   now.Add(time.Hour),
+				isCA:       true,
+			}, caKey)
+			assert.NoError(t, err)
+			assert.True(t, ca.IsCA)
+			assert.NotZero(t, ca.KeyUsage&x509.KeyUsageCertSign)
+
+			key, err := generatePrivateKey(alg, rsaKeySize)
+			assert.NoError(t, err)
+			cert, err := generateCert(certTemplateOption{
+				commonName: "test",
+				hosts:      []string{"example.com", "127.0.0.1", " "},
+				notBefore:  now.Add(-time.Hour),
+				notAfter:   now.Add(time.Hour),
+				parentCert: ca,
+				parentKey:  caKey,
+			}, key)
+			assert.NoError(t, err)
+			assert.False(t, cert.IsCA)
+			assert.Equal(t, []string{"example.com"}, cert.DNSNames)
+			assert.Len(t, cert.IPAddresses, 1)
+			assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, cert.ExtKeyUsage)
+			assert.NoError(t, cert.CheckSignatureFrom(ca))
+		})
+	}
+}
+
+func Test_publicKeyMatches(t *testing.T) {
+	rsaKey, err := generatePrivateKey(RSA, 2048)
+	assert.NoError(t, err)
+	p256Key, err := generatePrivateKey(ECDSAP256, 0)
+	assert.NoError(t, err)
+	ed25519Key, err := generatePrivateKey(Ed25519, 0)
+	assert.NoError(t, err)
+
+	assert.NoError(t, publicKeyMatches(rsaKey.Public(), "", 2048))
+	assert.NoError(t, publicKeyMatches(rsaKey.Public(), RSA, 2048))
+	assert.Error(t, publicKeyMatches(rsaKey.Public(), RSA, 4096))
+	assert.Error(t, publicKeyMatches(rsaKey.Public(), ECDSAP256, 2048))
+	assert.NoError(t, publicKeyMatches(p256Key.Public(), ECDSAP256, 2048))
+	assert.Error(t, publicKeyMatches(p256Key.Public(), ECDSAP384, 2048))
+	assert.Error(t, publicKeyMatches(p256Key.Public(), "", 2048))
+	assert.NoError(t, publicKeyMatches(ed25519Key.Public(), Ed25519, 2048))
+	assert.Error(t, publicKeyMatches(ed25519Key.Public(), RSA, 2048))
+}
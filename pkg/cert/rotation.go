@@ -0,0 +1,216 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/mozillazg/pkiutil/pkg/decoder"
+	errors "golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// CA rotation is done in three phases so that the apiserver always trusts the served cert:
+//
+//  1. a new CA is generated and saved as next CA, the next CA is published to
+//     every caBundle together with the current CA.
+//  2. after CAPropagationDelay since the next CA was published, the next CA becomes the
+//     current CA and the server cert is re-issued by it, the old CA is saved as previous CA
+//     and it is still trusted.
+//  3. after CAPropagationDelay since the rotation, the previous CA is dropped from caBundle.
+const (
+	nextCACertName     = "ca-next.crt"
+	nextCAKeyName      = "ca-next.key"
+	previousCACertName = "ca-previous.crt"
+
+	annotationPrefix            = "webhookcert.mozillazg.github.io/"
+	nextCAPublishedAtAnnotation = annotationPrefix + "ca-next-published-at"
+	caRotatedAtAnnotation       = annotationPrefix + "ca-rotated-at"
+
+	caPropagationDelay = time.Minute * 10
+)
+
+// canRotateCA reports whether the CA in secret can be rotated in phases,
+// which requires a CA key and a CA that is not expired yet.
+func (c *certManager) canRotateCA(secret *corev1.Secret, now time.Time) bool {
+	if c.certOpt.CAPropagationDelay < 0 || !c.saveCAKey() {
+		return false
+	}
+	ca, err := c.buildArtifactsFromSecret(secret)
+	if err != nil || ca.key == nil {
+		return false
+	}
+	return certIsValid(ca.cert, now, 0) == nil
+}
+
+// rotateCA moves the CA rotation in secret forward, it returns false if secret is not changed
+func (c *certManager) rotateCA(secret *corev1.Secret, now time.Time) (bool, error) {
+	current, err := c.buildArtifactsFromSecret(secret)
+	if err != nil {
+		return false, err
+	}
+	next, err := c.nextCAFromSecret(secret, now)
+	if err != nil {
+		klog.Warningf("next ca is not ready, will create next ca: %s", err)
+		begin := now.Add(-1 * time.Hour)
+		next, err = c.createCACert(begin, now.Add(c.certOpt.getCAValidityDuration()))
+		if err != nil {
+			return false, errors.Errorf("create next ca cert: %w", err)
+		}
+		secret.Data[nextCACertName] = next.certPEM
+		if err := c.setCAKey(secret, nextCAKeyName, next.keyPEM); err != nil {
+			return false, err
+		}
+		delete(secret.Annotations, nextCAPublishedAtAnnotation)
+		if _, err := c.renewServerCertIfInvalid(secret, current, now); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	publishedAt, ok := annotationTime(secret, nextCAPublishedAtAnnotation)
+	if !ok || now.Before(publishedAt.Add(c.certOpt.getCAPropagationDelay())) {
+		klog.Infof("waiting for next ca to be propagated")
+		return c.renewServerCertIfInvalid(secret, current, now)
+	}
+
+	klog.Info("next ca has been propagated, will switch to next ca")
+	secret.Data[previousCACertName] = current.certPEM
+	delete(secret.Data, nextCACertName)
+	delete(secret.Data, nextCAKeyName)
+	if err := c.issueServerCert(secret, next); err != nil {
+		return false, errors.Errorf("new server cert: %w", err)
+	}
+	delete(secret.Annotations, nextCAPublishedAtAnnotation)
+	setAnnotationTime(secret, caRotatedAtAnnotation, now)
+	return true, nil
+}
+
+func (c *certManager) renewServerCertIfInvalid(secret *corev1.Secret, ca *keyPairArtifacts, now time.Time) (bool, error) {
+	if err := c.serverCertIsValid(secret, now); err == nil {
+		return false, nil
+	}
+	if err := c.issueServerCert(secret, ca); err != nil {
+		return false, errors.Errorf("new server cert: %w", err)
+	}
+	return true, nil
+}
+
+func (c *certManager) nextCAFromSecret(secret *corev1.Secret, now time.Time) (*keyPairArtifacts, error) {
+	certPem, ok := secret.Data[nextCACertName]
+	if !ok {
+		return nil, errors.Errorf("missing %s", nextCACertName)
+	}
+	keyPem, ok := secret.Data[nextCAKeyName]
+	if !ok {
+		return nil, errors.Errorf("missing %s", nextCAKeyName)
+	}
+	keyPem, err := c.decryptCAKey(nextCAKeyName, keyPem)
+	if err != nil {
+		return nil, err
+	}
+	cert, _, err := decoder.DecodePemCert(certPem)
+	if err != nil {
+		return nil, errors.Errorf("while parsing next CA cert: %w", err)
+	}
+	key, err := decodePrivateKeyPEM(keyPem)
+	if err != nil {
+		return nil, errors.Errorf("while parsing next CA key: %w", err)
+	}
+	if err := certIsValid(cert, now, c.certOpt.getRenewBefore(cert)); err != nil {
+		return nil, err
+	}
+	// the next CA is created again when the options are changed during the rotation
+	if err := c.caCertMatchesOption(cert, c.certOpt.CAName); err != nil {
+		return nil, err
+	}
+	return &keyPairArtifacts{cert: cert, key: key, certPEM: certPem, keyPEM: keyPem}, nil
+}
+
+// caBundle returns the CA certs that should be trusted and
+// the CA certs that should be removed from caBundle.
+// the previous CA is left to CABundleRetention after CAPropagationDelay if MaxPreviousCAs is set
+func (c *certManager) caBundle(secret *corev1.Secret, now time.Time) (trusted, untrusted []byte) {
+	trusted = append(trusted, rootCAPEM(secret.Data[c.secretInfo.getCACertName()])...)
+	if next, ok := secret.Data[nextCACertName]; ok {
+		trusted = appendPEM(trusted, next)
+	}
+	if previous, ok := secret.Data[previousCACertName]; ok {
+		rotatedAt, ok := annotationTime(secret, caRotatedAtAnnotation)
+		if ok && now.Before(rotatedAt.Add(c.certOpt.getCAPropagationDelay())) {
+			trusted = appendPEM(trusted, previous)
+		} else if c.certOpt.CABundleRetention.MaxPreviousCAs <= 0 {
+			untrusted = previous
+		}
+	}
+	return trusted, untrusted
+}
+
+// markCAPublished records the time when the next CA in secret is published to caBundle
+func (c *certManager) markCAPublished(ctx context.Context, secret *corev1.Secret) (*corev1.Secret, error) {
+	if _, ok := secret.Data[nextCACertName]; !ok {
+		return secret, nil
+	}
+	if _, ok := annotationTime(secret, nextCAPublishedAtAnnotation); ok {
+		return secret, nil
+	}
+	secret = secret.DeepCopy()
+	setAnnotationTime(secret, nextCAPublishedAtAnnotation, c.now())
+	newSecret, err := c.updateSecret(ctx, secret)
+	if err != nil {
+		return nil, errors.Errorf("update secret %s: %w", secret.Name, err)
+	}
+	klog.Infof("next ca in secret %s is published", secret.Name)
+	return newSecret, nil
+}
+
+// caRotationTime returns the time when the CA rotation in secret can move to next phase
+func (c *certManager) caRotationTime(secret *corev1.Secret) (time.Time, bool) {
+	if _, ok := secret.Data[nextCACertName]; ok {
+		if t, ok := annotationTime(secret, nextCAPublishedAtAnnotation); ok {
+			return t.Add(c.certOpt.getCAPropagationDelay()), true
+		}
+		return c.now(), true
+	}
+	if _, ok := secret.Data[previousCACertName]; ok {
+		if t, ok := annotationTime(secret, caRotatedAtAnnotation); ok {
+			if t = t.Add(c.certOpt.getCAPropagationDelay()); t.After(c.now()) {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+func resetCARotation(secret *corev1.Secret) {
+	delete(secret.Annotations, nextCAPublishedAtAnnotation)
+	delete(secret.Annotations, caRotatedAtAnnotation)
+}
+
+func annotationTime(secret *corev1.Secret, key string) (time.Time, bool) {
+	v, ok := secret.Annotations[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		klog.Warningf("parse annotation %s of secret %s failed: %s", key, secret.Name, err)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func setAnnotationTime(secret *corev1.Secret, key string, t time.Time) {
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[key] = t.UTC().Format(time.RFC3339)
+}
+
+func appendPEM(pemCerts []byte, newPemCerts []byte) []byte {
+	if len(pemCerts) > 0 && !bytes.HasSuffix(pemCerts, []byte("\n")) {
+		pemCerts = append(pemCerts, '\n')
+	}
+	return append(pemCerts, newPemCerts...)
+}
@@ -0,0 +1,224 @@
+package cert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func getCABundleForTesting(t *testing.T, res *mockResourceInterface) []byte {
+	obj := &v1.ValidatingWebhookConfiguration{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(res.updateData.inputData.Object, obj)
+	assert.NoError(t, err)
+	return obj.Webhooks[0].ClientConfig.CABundle
+}
+
+func TestWebhookCert_ensureCert_staged_ca_rotation(t *testing.T) {
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	certOpt := CertOption{
+		CAName:                     "ca",
+		Hosts:                      []string{"example.com"},
+		CommonName:                 "test",
+		CAValidityDuration:         time.Hour * 24 * 30,
+		ServerCertValidityDuration: time.Hour * 24 * 10,
+		RenewBefore:                time.Hour * 24 * 5,
+		CAPropagationDelay:         time.Hour,
+		SecretInfo:                 SecretInfo{Name: "test"},
+	}
+	secretClient := &FakeSecretInterface{}
+	object := &v1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Webhooks:   []v1.ValidatingWebhook{{Name: "test1"}},
+	}
+	obj, _ := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	res := &mockResourceInterface{
+		getData:    &mockResourceInterfaceData{data: &unstructured.Unstructured{Object: obj}},
+		updateData: &mockResourceInterfaceData{},
+	}
+	w := &WebhookCert{
+		certOpt: certOpt,
+		certmanager: &certManager{
+			secretInfo:   certOpt.SecretInfo,
+			certOpt:      certOpt,
+			secretClient: secretClient,
+			clock:        fakeClock,
+		},
+		webhookmanager: &webhookManager{
+			webhooks: []WebhookInfo{{Type: ValidatingV1, Name: "test"}},
+			resourceClientGetter: func(resource schema.GroupVersionResource) resourceInterface {
+				return res
+			},
+		},
+	}
+	ensure := func() []byte {
+		secret, err := w.ensureCert(context.TODO())
+		assert.NoError(t, err)
+		secretClient.getSecret = secret.DeepCopy()
+		res.getData.data = res.updateData.inputData
+		return getCABundleForTesting(t, res)
+	}
+	start := fakeClock.Now()
+	bundle := ensure()
+	oldCA := secretClient.getSecret.Data["ca.crt"]
+	assert.Equal(t, string(oldCA), string(bundle))
+
+	// phase 1: publish next ca
+	fakeClock.SetTime(start.Add(time.Hour * 24 * 26))
+	bundle = ensure()
+	secret := secretClient.getSecret
+	nextCA := secret.Data[nextCACertName]
+	assert.NotEmpty(t, nextCA)
+	assert.Equal(t, string(oldCA), string(secret.Data["ca.crt"]))
+	assert.Contains(t, string(bundle), string(oldCA))
+	assert.Contains(t, string(bundle), string(nextCA))
+	assert.Contains(t, secret.Annotations, nextCAPublishedAtAnnotation)
+	renewAt, err := w.certmanager.nextRenewTime(secret)
+	assert.NoError(t, err)
+	assert.Equal(t, fakeClock.Now().Add(time.Hour).Unix(), renewAt.Unix())
+
+	// still waiting for propagation
+	fakeClock.SetTime(fakeClock.Now().Add(time.Minute * 30))
+	ensure()
+	assert.Equal(t, string(oldCA), string(secretClient.getSecret.Data["ca.crt"]))
+
+	// phase 2: switch server cert to next ca, old ca is still trusted
+	fakeClock.SetTime(fakeClock.Now().Add(time.Minute * 31))
+	bundle = ensure()
+	secret = secretClient.getSecret
+	assert.Equal(t, string(nextCA), string(secret.Data["ca.crt"]))
+	assert.Equal(t, string(oldCA), string(secret.Data[previousCACertName]))
+	assert.NotContains(t, secret.Data, nextCACertName)
+	assert.NotContains(t, secret.Data, nextCAKeyName)
+	assert.NoError(t, w.certmanager.certSecretIsValid(secret, fakeClock.Now()))
+	assert.Contains(t, string(bundle), string(oldCA))
+	assert.Contains(t, string(bundle), string(nextCA))
+
+	// phase 3: drop old ca
+	fakeClock.SetTime(fakeClock.Now().Add(time.Hour + time.Minute))
+	bundle = ensure()
+	assert.Equal(t, string(nextCA), string(bundle))
+}
+
+func TestWebhookCert_ensureCert_ca_rotation_keeps_previous_cas(t *testing.T) {
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	retention := CABundleRetention{MaxPreviousCAs: 2}
+	certOpt := CertOption{
+		CAName:                     "ca",
+		Hosts:                      []string{"example.com"},
+		CommonName:                 "test",
+		CAValidityDuration:         time.Hour * 24 * 30,
+		ServerCertValidityDuration: time.Hour * 24 * 10,
+		RenewBefore:                time.Hour * 24 * 5,
+		CAPropagationDelay:         time.Hour,
+		CABundleRetention:          retention,
+		SecretInfo:                 SecretInfo{Name: "test"},
+	}
+	secretClient := &FakeSecretInterface{}
+	object := &v1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Webhooks:   []v1.ValidatingWebhook{{Name: "test1"}},
+	}
+	obj, _ := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	res := &mockResourceInterface{
+		getData:    &mockResourceInterfaceData{data: &unstructured.Unstructured{Object: obj}},
+		updateData: &mockResourceInterfaceData{},
+	}
+	w := &WebhookCert{
+		certOpt: certOpt,
+		certmanager: &certManager{
+			secretInfo:   certOpt.SecretInfo,
+			certOpt:      certOpt,
+			secretClient: secretClient,
+			clock:        fakeClock,
+		},
+		webhookmanager: &webhookManager{
+			webhooks:          []WebhookInfo{{Type: ValidatingV1, Name: "test"}},
+			caBundleRetention: retention,
+			resourceClientGetter: func(resource schema.GroupVersionResource) resourceInterface {
+				return res
+			},
+		},
+	}
+	ensure := func() []byte {
+		_, err := w.ensureCert(context.TODO())
+		assert.NoError(t, err)
+		res.getData.data = res.updateData.inputData
+		return getCABundleForTesting(t, res)
+	}
+	// rotate moves the CA rotation through all phases and returns the caBundle
+	rotate := func() []byte {
+		fakeClock.SetTime(fakeClock.Now().Add(time.Hour * 24 * 26))
+		ensure()
+		fakeClock.SetTime(fakeClock.Now().Add(time.Hour + time.Minute))
+		ensure()
+		fakeClock.SetTime(fakeClock.Now().Add(time.Hour + time.Minute))
+		return ensure()
+	}
+	ensure()
+	ca1 := secretClient.getSecret.Data["ca.crt"]
+
+	bundle := rotate()
+	ca2 := secretClient.getSecret.Data["ca.crt"]
+	assert.NotEqual(t, ca1, ca2)
+	assert.Len(t, decodePEMCerts(bundle).Certificate, 2)
+	assert.Contains(t, string(bundle), string(ca1))
+
+	bundle = rotate()
+	ca3 := secretClient.getSecret.Data["ca.crt"]
+	assert.NotEqual(t, ca2, ca3)
+	assert.Len(t, decodePEMCerts(bundle).Certificate, 3)
+	for _, ca := range [][]byte{ca1, ca2, ca3} {
+		assert.Contains(t, string(bundle), string(ca))
+	}
+
+	// the oldest CA is dropped
+	bundle = rotate()
+	assert.Len(t, decodePEMCerts(bundle).Certificate, 3)
+	assert.NotContains(t, string(bundle), string(ca1))
+	assert.Contains(t, string(bundle), string(ca2))
+}
+
+func TestCertManager_ensureSecret_rotate_ca_immediately_when_expired(t *testing.T) {
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	secretClient := &FakeSecretInterface{}
+	c := certManager{
+		secretInfo: SecretInfo{Name: "test"},
+		certOpt: CertOption{
+			CAName:               "ca",
+			Hosts:                []string{"example.com"},
+			CommonName:           "test",
+			CertValidityDuration: time.Hour * 24,
+		},
+		secretClient: secretClient,
+		clock:        fakeClock,
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	secretClient.getSecret = s.DeepCopy()
+
+	fakeClock.SetTime(fakeClock.Now().Add(time.Hour * 24))
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.NotEqual(t, string(s.Data["ca.crt"]), string(newS.Data["ca.crt"]))
+	assert.NotContains(t, newS.Data, nextCACertName)
+}
+
+func Test_mergeCAPemCerts_untrusted(t *testing.T) {
+	bundle := appendPEM([]byte(caPemForTestA), []byte(caPemForTestB))
+
+	changed, certs := mergeCAPemCerts(bundle, []byte(caPemForTestA), []byte(caPemForTestB), CABundleRetention{})
+	assert.True(t, changed)
+	assert.Equal(t, caPemForTestA[1:], string(certs))
+
+	changed, certs = mergeCAPemCerts([]byte(caPemForTestA), []byte(caPemForTestA), []byte(caPemForTestB), CABundleRetention{})
+	assert.False(t, changed)
+	assert.Equal(t, caPemForTestA, string(certs))
+}
@@ -3,22 +3,23 @@ package cert
 import (
 	"bytes"
 	"context"
-	"crypto/rsa"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/mozillazg/pkiutil/pkg/decoder"
 	"github.com/mozillazg/pkiutil/pkg/encoder"
-	certgen "github.com/mozillazg/pkiutil/pkg/generator"
 	errors "golang.org/x/xerrors"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/util/retry"
 	klog "k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 )
 
 const (
@@ -27,46 +28,68 @@ const (
 	caCertName           = "ca.crt"
 	caKeyName            = "ca.key"
 	certValidityDuration = time.Hour * 24 * 365 * 100 // 100 years
+	renewBefore          = time.Hour * 24 * 7
+	renewCheckInterval   = time.Hour
+	renewRetryInterval   = time.Minute
+	renewMinInterval     = time.Second * 10
 	rsaKeySize           = 2048
 )
 
 type keyPairArtifacts struct {
 	cert    *x509.Certificate
-	key     *rsa.PrivateKey
+	key     crypto.Signer
 	certPEM []byte
 	keyPEM  []byte
+	// certs appended to the server cert issued by this CA
+	chainPEM []byte
 }
 
 type SecretInfo struct {
 	Name      string
 	Namespace string
 
-	caCertName string
-	caKeyName  string
-	certName   string
-	keyName    string
-
-	// dont save ca key to secret?
-	dontSaveCaKey bool
+	// key of CA cert in secret, default: ca.crt
+	CACertName string
+	// key of CA key in secret, default: ca.key
+	CAKeyName string
+	// key of server cert in secret, default: tls.crt
+	CertName string
+	// key of server key in secret, default: tls.key
+	KeyName string
+
+	// dont save CA key to secret, the CA and the server cert will be
+	// regenerated together because the server cert can not be renewed without CA key
+	DontSaveCAKey bool
 }
 
 type certManager struct {
 	secretInfo   SecretInfo
 	certOpt      CertOption
-	secretClient secretInterface
-}
-
-type secretInterface interface {
-	Create(ctx context.Context, secret *corev1.Secret, opts metav1.CreateOptions) (*corev1.Secret, error)
-	Update(ctx context.Context, secret *corev1.Secret, opts metav1.UpdateOptions) (*corev1.Secret, error)
-	Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Secret, error)
+	secretClient SecretStore
+	clock        clock.PassiveClock
+
+	// secret to save CA material, CA material is saved to secretInfo if caSecretInfo.Name is empty
+	caSecretInfo   SecretInfo
+	caSecretClient SecretStore
+	// client of the secret of CertOption.ExternalCA
+	externalCASecretClient SecretStore
+	// clients for CertOption.CSRSigner
+	csrClient csrInterface
+	// client of CertOption.IssueLease
+	leaseClient leaseInterface
 }
 
+// ensureSecret checks and issues certs, it is safe to be called by multiple replicas at once:
+// secrets are updated with resourceVersion preconditions, and the replica which fails with
+// AlreadyExists or Conflict reads the secret saved by others again instead of overwriting it.
 func (c *certManager) ensureSecret(ctx context.Context) (*corev1.Secret, error) {
 	var secret *corev1.Secret
 	var err error
 
 	retry.OnError(retry.DefaultBackoff, func(err error) bool {
+		if apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err) {
+			klog.Warningf("secret %s is changed by others, will check it again: %s", c.secretInfo.Name, err)
+		}
 		return err != nil
 	}, func() error {
 		secret, err = c.ensureSecretWithoutRetry(ctx)
@@ -77,9 +100,17 @@ func (c *certManager) ensureSecret(ctx context.Context) (*corev1.Secret, error)
 }
 
 func (c *certManager) ensureSecretWithoutRetry(ctx context.Context) (*corev1.Secret, error) {
-	client := c.secretClient
+	if err := c.certOpt.validateCASource(); err != nil {
+		return nil, err
+	}
+	if c.certOpt.ExternalCA != nil {
+		return c.ensureSecretWithExternalCA(ctx)
+	}
+	if issuer := c.issuer(); issuer != nil {
+		return c.ensureSecretWithIssuer(ctx, issuer)
+	}
 	name := c.secretInfo.Name
-	secret, err := client.Get(ctx, name, metav1.GetOptions{})
+	secret, err := c.getSecret(ctx)
 	if err != nil {
 		if !apierrors.IsNotFound(err) {
 			return nil, errors.Errorf("get secret %s: %w", name, err)
@@ -89,36 +120,77 @@ func (c *certManager) ensureSecretWithoutRetry(ctx context.Context) (*corev1.Sec
 		if err != nil {
 			return nil, errors.Errorf("new secret: %w", err)
 		}
-		return client.Create(ctx, newSecret, metav1.CreateOptions{})
+		return c.createSecret(ctx, newSecret)
 	}
 
-	checkNotAfter := time.Now().Add(-wait.Jitter(time.Hour*24*7, 0.5))
-	if err := c.certSecretIsValid(secret, time.Now(), checkNotAfter); err != nil {
-		klog.Warningf("parse cert from secret %s failed, will update exist secret: %s", name, err)
+	now := c.now()
+	ca, err := c.caSecretIsValid(secret, now)
+	if err != nil {
+		var decryptErr *caKeyDecryptError
+		if errors.As(err, &decryptErr) {
+			return nil, err
+		}
+		if c.canRotateCA(secret, now) {
+			klog.Warningf("ca cert from secret %s will be expired or options are changed, will rotate ca: %s", name, err)
+			changed, err := c.rotateCA(secret, now)
+			if err != nil {
+				return nil, errors.Errorf("rotate ca: %w", err)
+			}
+			if !changed {
+				return secret, nil
+			}
+			return c.updateSecret(ctx, secret)
+		}
+		klog.Warningf("parse ca cert from secret %s failed, will update exist secret: %s", name, err)
 		newSecret, err := c.newSecret()
 		if err != nil {
 			return nil, errors.Errorf("new secret: %w", err)
 		}
 		secret.Data = newSecret.Data
-		return client.Update(ctx, secret, metav1.UpdateOptions{})
+		resetCARotation(secret)
+		return c.updateSecret(ctx, secret)
+	}
+	err = c.serverCertIsValid(secret, now)
+	if err == nil {
+		err = c.verifyServerCertChain(secret, now)
+	}
+	if err != nil {
+		if ca.key == nil {
+			klog.Warningf("parse server cert from secret %s failed and ca key is not saved, will update exist secret: %s", name, err)
+			newSecret, err := c.newSecret()
+			if err != nil {
+				return nil, errors.Errorf("new secret: %w", err)
+			}
+			secret.Data = newSecret.Data
+			resetCARotation(secret)
+			return c.updateSecret(ctx, secret)
+		}
+		klog.Warningf("parse server cert from secret %s failed, will renew server cert: %s", name, err)
+		if err := c.issueServerCert(secret, ca); err != nil {
+			return nil, errors.Errorf("new server cert: %w", err)
+		}
+		return c.updateSecret(ctx, secret)
+	}
+	changed, err := c.encryptCAKeys(secret)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		klog.Infof("ca keys in secret %s are not encrypted, will encrypt them", name)
+		return c.updateSecret(ctx, secret)
 	}
 	klog.Infof("use exist secret %s", name)
 	return secret, nil
 }
 
 func (c *certManager) newSecret() (*corev1.Secret, error) {
-	var caArtifacts *keyPairArtifacts
-	now := time.Now()
+	now := c.now()
 	begin := now.Add(-1 * time.Hour)
-	end := now.Add(c.certOpt.getCertValidityDuration())
+	end := now.Add(c.certOpt.getCAValidityDuration())
 	caArtifacts, err := c.createCACert(begin, end)
 	if err != nil {
 		return nil, errors.Errorf("create ca cert: %w", err)
 	}
-	cert, key, err := c.createCertPEM(caArtifacts, begin, end)
-	if err != nil {
-		return nil, errors.Errorf("create cert: %w", err)
-	}
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      c.secretInfo.Name,
@@ -126,44 +198,104 @@ func (c *certManager) newSecret() (*corev1.Secret, error) {
 		},
 		Data: map[string][]byte{},
 	}
-	c.populateSecret(cert, key, caArtifacts, secret)
+	if err := c.issueServerCert(secret, caArtifacts); err != nil {
+		return nil, errors.Errorf("create cert: %w", err)
+	}
 	return secret, nil
 }
 
-func (c *certManager) populateSecret(cert, key []byte, caArtifacts *keyPairArtifacts, secret *corev1.Secret) {
+// issueServerCert issues a new server cert by ca and saves it to secret together with ca,
+// the server cert is issued by an intermediate CA signed by ca if CertOption.IntermediateCA is true
+func (c *certManager) issueServerCert(secret *corev1.Secret, ca *keyPairArtifacts) error {
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	issuer := ca
+	if c.certOpt.IntermediateCA && c.selfGeneratedCA() {
+		var err error
+		if issuer, err = c.ensureIntermediateCA(secret, ca); err != nil {
+			return errors.Errorf("ensure intermediate ca: %w", err)
+		}
+	} else {
+		delete(secret.Data, intermediateCACertName)
+		delete(secret.Data, intermediateCAKeyName)
+	}
+	cert, key, err := c.newServerCertPEM(issuer)
+	if err != nil {
+		return err
+	}
+	return c.populateSecret(cert, key, ca, secret)
+}
+
+// newServerCertPEM issues a server cert signed by ca,
+// the server cert never outlives the ca.
+func (c *certManager) newServerCertPEM(ca *keyPairArtifacts) ([]byte, []byte, error) {
+	now := c.now()
+	begin := now.Add(-1 * time.Hour)
+	end := now.Add(c.certOpt.getServerCertValidityDuration())
+	if end.After(ca.cert.NotAfter) {
+		end = ca.cert.NotAfter
+	}
+	cert, key, err := c.createCertPEM(ca, begin, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ca.chainPEM) > 0 {
+		cert = appendPEM(cert, ca.chainPEM)
+	}
+	return cert, key, nil
+}
+
+func (c *certManager) populateSecret(cert, key []byte, caArtifacts *keyPairArtifacts, secret *corev1.Secret) error {
 	if secret.Data == nil {
 		secret.Data = make(map[string][]byte)
 	}
 	secret.Data[c.secretInfo.getCACertName()] = caArtifacts.certPEM
-	if !c.secretInfo.dontSaveCaKey {
-		secret.Data[c.secretInfo.getCAKeyName()] = caArtifacts.keyPEM
+	if c.saveCAKey() {
+		if err := c.setCAKey(secret, c.secretInfo.getCAKeyName(), caArtifacts.keyPEM); err != nil {
+			return err
+		}
 	}
 	secret.Data[c.secretInfo.getCertName()] = cert
 	secret.Data[c.secretInfo.getKeyName()] = key
+	return nil
 }
 
 func (c *certManager) buildArtifactsFromSecret(secret *corev1.Secret) (*keyPairArtifacts, error) {
-	caPem, ok := secret.Data[c.secretInfo.getCACertName()]
+	caCertName, caKeyName := c.secretInfo.getCACertName(), c.secretInfo.getCAKeyName()
+	caPem, ok := secret.Data[caCertName]
 	if !ok {
-		return nil, errors.New(fmt.Sprintf("Cert secret is not well-formed, missing %s", c.secretInfo.caCertName))
+		return nil, newInvalidCertError(caCertName, CertMissing,
+			errors.New(fmt.Sprintf("Cert secret is not well-formed, missing %s", caCertName)))
 	}
 	caCert, _, err := decoder.DecodePemCert(caPem)
 	if err != nil {
-		return nil, errors.Errorf("while parsing CA cert: %w", err)
+		return nil, newInvalidCertError(caCertName, CertMalformed, errors.Errorf("while parsing CA cert: %w", err))
+	}
+	if !caCert.IsCA || (caCert.KeyUsage != 0 && caCert.KeyUsage&x509.KeyUsageCertSign == 0) {
+		return nil, newInvalidCertError(caCertName, CertKeyUsageInvalid, errors.New("CA cert is not allowed to sign certs"))
 	}
 	kp := &keyPairArtifacts{
 		cert:    caCert,
 		certPEM: caPem,
 	}
 
-	if !c.secretInfo.dontSaveCaKey {
-		keyPem, ok := secret.Data[c.secretInfo.getCAKeyName()]
+	if c.saveCAKey() {
+		keyPem, ok := secret.Data[caKeyName]
 		if !ok {
-			return nil, errors.New(fmt.Sprintf("Cert secret is not well-formed, missing %s", c.secretInfo.caKeyName))
+			return nil, newInvalidCertError(caKeyName, CertMissing,
+				errors.New(fmt.Sprintf("Cert secret is not well-formed, missing %s", caKeyName)))
 		}
-		key, _, err := decoder.DecodePemPrivateKey(keyPem)
+		keyPem, err := c.decryptCAKey(caKeyName, keyPem)
 		if err != nil {
-			return nil, errors.Errorf("while parsing CA key: %w", err)
+			return nil, err
+		}
+		key, err := decodePrivateKeyPEM(keyPem)
+		if err != nil {
+			return nil, newInvalidCertError(caKeyName, CertMalformed, errors.Errorf("while parsing CA key: %w", err))
+		}
+		if err := keyMatchesCert(key, caCert); err != nil {
+			return nil, newInvalidCertError(caKeyName, CertKeyMismatch, err)
 		}
 		kp.keyPEM = keyPem
 		kp.key = key
@@ -171,46 +303,218 @@ func (c *certManager) buildArtifactsFromSecret(secret *corev1.Secret) (*keyPairA
 	return kp, nil
 }
 
-func (c *certManager) certSecretIsValid(secret *corev1.Secret, now, notAfter time.Time) error {
+// certSecretIsValid checks the CA and the server cert in secret,
+// an *InvalidCertError is returned to explain why they are invalid.
+// the expiration of the CA which is not self-generated is not checked, it is not renewed by us
+func (c *certManager) certSecretIsValid(secret *corev1.Secret, now time.Time) error {
+	if c.selfGeneratedCA() {
+		if _, err := c.caSecretIsValid(secret, now); err != nil {
+			return err
+		}
+	} else if _, err := c.buildArtifactsFromSecret(secret); err != nil {
+		return err
+	}
+	if err := c.serverCertIsValid(secret, now); err != nil {
+		return err
+	}
+	return c.verifyServerCertChain(secret, now)
+}
+
+func (c *certManager) caSecretIsValid(secret *corev1.Secret, now time.Time) (*keyPairArtifacts, error) {
 	ca, err := c.buildArtifactsFromSecret(secret)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := certIsValid(ca.cert, now, c.certOpt.getRenewBefore(ca.cert)); err != nil {
+		return nil, newInvalidCertError(c.secretInfo.getCACertName(), CertExpiring, err)
 	}
-	caCert := ca.cert
-	serverPem, ok := secret.Data[c.secretInfo.getCertName()]
+	if err := c.caCertMatchesOption(ca.cert, c.certOpt.CAName); err != nil {
+		return nil, newInvalidCertError(c.secretInfo.getCACertName(), CertOptionsChanged, err)
+	}
+	return ca, nil
+}
+
+// serverCertIsValid checks the server cert and key in secret, the chain of the server cert
+// is checked by verifyServerCertChain
+func (c *certManager) serverCertIsValid(secret *corev1.Secret, now time.Time) error {
+	certName, keyName := c.secretInfo.getCertName(), c.secretInfo.getKeyName()
+	serverPem, ok := secret.Data[certName]
 	if !ok {
-		return errors.New(fmt.Sprintf("Cert secret is not well-formed, missing %s", c.secretInfo.caCertName))
+		return newInvalidCertError(certName, CertMissing,
+			errors.New(fmt.Sprintf("Cert secret is not well-formed, missing %s", certName)))
 	}
-	serverKey, ok := secret.Data[c.secretInfo.getKeyName()]
+	serverKey, ok := secret.Data[keyName]
 	if !ok {
-		return errors.New(fmt.Sprintf("Cert secret is not well-formed, missing %s", c.secretInfo.caCertName))
+		return newInvalidCertError(keyName, CertMissing,
+			errors.New(fmt.Sprintf("Cert secret is not well-formed, missing %s", keyName)))
 	}
 	serverCert, _, err := decoder.DecodePemCert(serverPem)
 	if err != nil {
-		return errors.Errorf("while parsing server cert: %w", err)
+		return newInvalidCertError(certName, CertMalformed, errors.Errorf("while parsing server cert: %w", err))
+	}
+	key, err := decodePrivateKeyPEM(serverKey)
+	if err != nil {
+		return newInvalidCertError(keyName, CertMalformed, errors.Errorf("while parsing server key: %w", err))
+	}
+	if err := keyMatchesCert(key, serverCert); err != nil {
+		return newInvalidCertError(keyName, CertKeyMismatch, err)
 	}
-	if _, _, err := decoder.DecodePemPrivateKey(serverKey); err != nil {
-		return errors.Errorf("while parsing server key: %w", err)
+	if serverCert.IsCA || (serverCert.KeyUsage != 0 && serverCert.KeyUsage&x509.KeyUsageDigitalSignature == 0) {
+		return newInvalidCertError(certName, CertKeyUsageInvalid, errors.New("server cert is a CA or not allowed to sign"))
+	}
+	if err := c.serverCertMatchesOption(serverCert); err != nil {
+		return newInvalidCertError(certName, CertOptionsChanged, err)
 	}
 
-	if err := certIsValid(caCert, now, notAfter); err != nil {
-		return err
+	if err := certIsValid(serverCert, now, c.certOpt.getRenewBefore(serverCert)); err != nil {
+		return newInvalidCertError(certName, CertExpiring, err)
 	}
-	if err := certIsValid(serverCert, now, notAfter); err != nil {
-		return err
+	return nil
+}
+
+// serverCertMatchesOption checks whether the server cert is issued with the current hosts, subject
+// and key parameters of CertOption. the cert issued by an Issuer only needs to cover the hosts,
+// the Issuer may add hosts or change the subject.
+func (c *certManager) serverCertMatchesOption(cert *x509.Certificate) error {
+	if err := publicKeyMatches(cert.PublicKey, c.certOpt.KeyAlgorithm, c.certOpt.getRSAKeySize()); err != nil {
+		return errors.Errorf("server cert does not match key options: %w", err)
 	}
 
+	dnsNames, ips := splitHosts(c.certOpt.getHots())
+	want := sets.NewString()
+	for _, name := range dnsNames {
+		want.Insert(strings.ToLower(name))
+	}
+	for _, ip := range ips {
+		want.Insert(ip.String())
+	}
+	got := sets.NewString()
+	for _, name := range cert.DNSNames {
+		got.Insert(strings.ToLower(name))
+	}
+	for _, ip := range cert.IPAddresses {
+		got.Insert(ip.String())
+	}
+	if missing := want.Difference(got); missing.Len() > 0 {
+		return errors.Errorf("server cert does not contain hosts %v", missing.List())
+	}
+	if c.issuer() != nil {
+		return nil
+	}
+	if extra := got.Difference(want); extra.Len() > 0 {
+		return errors.Errorf("server cert contains hosts %v which are not in options", extra.List())
+	}
+	if cert.Subject.CommonName != c.certOpt.CommonName {
+		return errors.Errorf("common name of server cert is %q, want %q", cert.Subject.CommonName, c.certOpt.CommonName)
+	}
+	if !sets.NewString(cert.Subject.Organization...).Equal(sets.NewString(c.certOpt.getOrganizations()...)) {
+		return errors.Errorf("organizations of server cert are %v, want %v", cert.Subject.Organization, c.certOpt.getOrganizations())
+	}
+	return nil
+}
+
+// caCertMatchesOption checks whether the self-generated CA is created with commonName and
+// the current organizations and key parameters of CertOption
+func (c *certManager) caCertMatchesOption(cert *x509.Certificate, commonName string) error {
+	if err := publicKeyMatches(cert.PublicKey, c.certOpt.KeyAlgorithm, c.certOpt.getRSAKeySize()); err != nil {
+		return errors.Errorf("ca cert does not match key options: %w", err)
+	}
+	if cert.Subject.CommonName != commonName {
+		return errors.Errorf("common name of ca cert is %q, want %q", cert.Subject.CommonName, commonName)
+	}
+	if !sets.NewString(cert.Subject.Organization...).Equal(sets.NewString(c.certOpt.getOrganizations()...)) {
+		return errors.Errorf("organizations of ca cert are %v, want %v", cert.Subject.Organization, c.certOpt.getOrganizations())
+	}
 	return nil
 }
 
+// verifyServerCertChain verifies the server cert and the intermediate CAs following it up to
+// the CA certs in secret, they may be mismatched if only one of the CA secret and
+// the serving secret was saved
+func (c *certManager) verifyServerCertChain(secret *corev1.Secret, now time.Time) error {
+	certName, caCertName := c.secretInfo.getCertName(), c.secretInfo.getCACertName()
+	certs, err := decoder.DecodePemCerts(bytes.TrimSpace(secret.Data[certName]))
+	if err != nil {
+		return newInvalidCertError(certName, CertMalformed, errors.Errorf("while parsing server cert: %w", err))
+	}
+	if len(certs) == 0 {
+		return newInvalidCertError(certName, CertMissing,
+			errors.New(fmt.Sprintf("Cert secret is not well-formed, missing %s", certName)))
+	}
+	caCerts, err := decoder.DecodePemCerts(bytes.TrimSpace(secret.Data[caCertName]))
+	if err != nil {
+		return newInvalidCertError(caCertName, CertMalformed, errors.Errorf("while parsing CA cert: %w", err))
+	}
+	roots := x509.NewCertPool()
+	for _, cert := range caCerts {
+		roots.AddCert(cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		var invalidErr x509.CertificateInvalidError
+		if errors.As(err, &invalidErr) && invalidErr.Reason == x509.IncompatibleUsage {
+			return newInvalidCertError(certName, CertKeyUsageInvalid, errors.Errorf("server cert is not allowed for server auth: %w", err))
+		}
+		return newInvalidCertError(certName, CertNotIssuedByCA, errors.Errorf("server cert is not issued by current ca: %w", err))
+	}
+	return nil
+}
+
+// nextRenewTime returns the earliest renewal time of the certs in secret,
+// including the time when the CA rotation can move to next phase
+func (c *certManager) nextRenewTime(secret *corev1.Secret) (time.Time, error) {
+	ca, err := c.buildArtifactsFromSecret(secret)
+	if err != nil {
+		return time.Time{}, err
+	}
+	serverCert, _, err := decoder.DecodePemCert(secret.Data[c.secretInfo.getCertName()])
+	if err != nil {
+		return time.Time{}, errors.Errorf("while parsing server cert: %w", err)
+	}
+	renewAt := serverCert.NotAfter.Add(-c.certOpt.getRenewBefore(serverCert))
+	// the current CA is being rotated, the time of next phase is used instead.
+	// the CA which is not self-generated is not renewed by us
+	if _, ok := secret.Data[nextCACertName]; !ok && c.selfGeneratedCA() {
+		if t := ca.cert.NotAfter.Add(-c.certOpt.getRenewBefore(ca.cert)); t.Before(renewAt) {
+			renewAt = t
+		}
+	}
+	if t, ok := c.caRotationTime(secret); ok && t.Before(renewAt) {
+		renewAt = t
+	}
+	return renewAt, nil
+}
+
 func (c *certManager) createCACert(begin, end time.Time) (*keyPairArtifacts, error) {
-	cert, key, err := certgen.GenCACert(certgen.CertOption{
-		CommonName:    c.certOpt.CAName,
-		Organizations: c.certOpt.getOrganizations(),
-		NotBefore:     begin,
-		NotAfter:      end,
-		RSAKeySize:    c.certOpt.getRSAKeySize(),
-	})
+	return c.createCA(c.certOpt.CAName, nil, begin, end)
+}
+
+// createCA creates a CA signed by parent, the CA is self-signed if parent is nil
+func (c *certManager) createCA(commonName string, parent *keyPairArtifacts, begin, end time.Time) (*keyPairArtifacts, error) {
+	key, err := generatePrivateKey(c.certOpt.KeyAlgorithm, c.certOpt.getRSAKeySize())
+	if err != nil {
+		return nil, errors.Errorf("generating key: %w", err)
+	}
+	opt := certTemplateOption{
+		commonName:    commonName,
+		organizations: c.certOpt.getOrganizations(),
+		notBefore:     begin,
+		notAfter:      end,
+		isCA:          true,
+	}
+	if parent != nil {
+		opt.parentCert = parent.cert
+		opt.parentKey = parent.key
+	}
+	cert, err := generateCert(opt, key)
 	if err != nil {
 		return nil, errors.Errorf("generating cert: %w", err)
 	}
@@ -218,7 +522,7 @@ func (c *certManager) createCACert(begin, end time.Time) (*keyPairArtifacts, err
 	if err != nil {
 		return nil, errors.Errorf("encoding PEM: %w", err)
 	}
-	keyPem, err := encoder.PemEncodePrivateKey(key)
+	keyPem, err := encodePrivateKeyPEM(key)
 	if err != nil {
 		return nil, errors.Errorf("encoding PEM: %w", err)
 	}
@@ -226,16 +530,19 @@ func (c *certManager) createCACert(begin, end time.Time) (*keyPairArtifacts, err
 }
 
 func (c *certManager) createCertPEM(ca *keyPairArtifacts, begin, end time.Time) ([]byte, []byte, error) {
-	cert, key, err := certgen.GenServerCert(certgen.CertOption{
-		CommonName:    c.certOpt.CommonName,
-		Organizations: c.certOpt.getOrganizations(),
-		Hosts:         c.certOpt.getHots(),
-		NotBefore:     begin,
-		NotAfter:      end,
-		RSAKeySize:    c.certOpt.getRSAKeySize(),
-		ParentCert:    ca.cert,
-		ParentKey:     ca.key,
-	})
+	key, err := generatePrivateKey(c.certOpt.KeyAlgorithm, c.certOpt.getRSAKeySize())
+	if err != nil {
+		return nil, nil, errors.Errorf("generating key: %w", err)
+	}
+	cert, err := generateCert(certTemplateOption{
+		commonName:    c.certOpt.CommonName,
+		organizations: c.certOpt.getOrganizations(),
+		hosts:         c.certOpt.getHots(),
+		notBefore:     begin,
+		notAfter:      end,
+		parentCert:    ca.cert,
+		parentKey:     ca.key,
+	}, key)
 	if err != nil {
 		return nil, nil, errors.Errorf("generating cert: %w", err)
 	}
@@ -243,7 +550,7 @@ func (c *certManager) createCertPEM(ca *keyPairArtifacts, begin, end time.Time)
 	if err != nil {
 		return nil, nil, errors.Errorf("encoding PEM: %w", err)
 	}
-	keyPem, err := encoder.PemEncodePrivateKey(key)
+	keyPem, err := encodePrivateKeyPEM(key)
 	if err != nil {
 		return nil, nil, errors.Errorf("encoding PEM: %w", err)
 	}
@@ -251,57 +558,80 @@ func (c *certManager) createCertPEM(ca *keyPairArtifacts, begin, end time.Time)
 }
 
 func (s SecretInfo) getCACertName() string {
-	if s.caCertName != "" {
-		return s.caCertName
+	if s.CACertName != "" {
+		return s.CACertName
 	}
 	return caCertName
 }
 
 func (s SecretInfo) getCAKeyName() string {
-	if s.caKeyName != "" {
-		return s.caKeyName
+	if s.CAKeyName != "" {
+		return s.CAKeyName
 	}
 	return caKeyName
 }
 
 func (s SecretInfo) getCertName() string {
-	if s.certName != "" {
-		return s.certName
+	if s.CertName != "" {
+		return s.CertName
 	}
 	return certName
 }
 
 func (s SecretInfo) getKeyName() string {
-	if s.keyName != "" {
-		return s.keyName
+	if s.KeyName != "" {
+		return s.KeyName
 	}
 	return keyName
 }
 
-func mergeCAPemCerts(pemCerts []byte, newPemCerts []byte) (changed bool, certs []byte) {
-	if bytes.Contains(pemCerts, bytes.TrimSpace(newPemCerts)) {
-		return false, pemCerts
-	}
-
-	var newCerts tls.Certificate
+func mergeCAPemCerts(pemCerts []byte, newPemCerts []byte, untrustedPemCerts []byte, retention CABundleRetention) (changed bool, certs []byte) {
 	oldCerts := decodePEMCerts(pemCerts)
-	var oldCertBytes []byte
-	// only merge one old ca
-	if len(oldCerts.Certificate) > 0 {
-		oldCertBytes = oldCerts.Certificate[0]
-	}
 	caCerts := decodePEMCerts(newPemCerts)
+	untrustedCerts := decodePEMCerts(untrustedPemCerts)
+	now := time.Now()
 
+	var newCerts tls.Certificate
 	// new ca then old ca
 	newCerts.Certificate = append(newCerts.Certificate, caCerts.Certificate...)
-	if len(oldCertBytes) > 0 {
-		newCerts.Certificate = append(newCerts.Certificate, oldCertBytes)
+	previous := 0
+	for _, c := range oldCerts.Certificate {
+		if previous >= retention.getMaxPreviousCAs() {
+			break
+		}
+		if containsCert(&newCerts, c) || containsCert(untrustedCerts, c) || !retention.keep(c, now) {
+			continue
+		}
+		newCerts.Certificate = append(newCerts.Certificate, c)
+		previous++
 	}
 
+	// the order of certs does not matter
+	if len(oldCerts.Certificate) == len(newCerts.Certificate) && containsAllCerts(oldCerts, &newCerts) {
+		return false, pemCerts
+	}
 	pemBytes, _ := encodePEMCerts(&newCerts)
 	return true, pemBytes
 }
 
+func containsCert(certs *tls.Certificate, cert []byte) bool {
+	for _, c := range certs.Certificate {
+		if bytes.Equal(c, cert) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAllCerts(certs *tls.Certificate, others *tls.Certificate) bool {
+	for _, c := range others.Certificate {
+		if !containsCert(certs, c) {
+			return false
+		}
+	}
+	return true
+}
+
 func decodePEMCerts(pemCerts []byte) *tls.Certificate {
 	var certs tls.Certificate
 	cs, err := decoder.DecodePemCerts(pemCerts)
@@ -321,24 +651,50 @@ func encodePEMCerts(certs *tls.Certificate) ([]byte, error) {
 	return data, nil
 }
 
-func certIsValid(c *x509.Certificate, now, notAfter time.Time) error {
+// removeSelfGeneratedCA removes the CA material of a self-generated CA from secret,
+// it is not used anymore when the server cert is not issued by a self-generated CA
+func (c *certManager) removeSelfGeneratedCA(secret *corev1.Secret) {
+	for _, k := range []string{c.secretInfo.getCAKeyName(), nextCACertName, nextCAKeyName,
+		previousCACertName, intermediateCACertName, intermediateCAKeyName} {
+		delete(secret.Data, k)
+	}
+	resetCARotation(secret)
+}
+
+// saveCAKey reports whether the CA key is saved to secret
+func (c *certManager) saveCAKey() bool {
+	return !c.secretInfo.DontSaveCAKey && c.selfGeneratedCA()
+}
+
+// selfGeneratedCA reports whether the server cert is issued by a CA generated by us
+func (c *certManager) selfGeneratedCA() bool {
+	return c.certOpt.ExternalCA == nil && c.certOpt.CSRSigner == nil && c.certOpt.Issuer == nil
+}
+
+func (c *certManager) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
+
+// certIsValid checks whether c is valid at now and will not expire within renewBefore
+func certIsValid(c *x509.Certificate, now time.Time, renewBefore time.Duration) error {
 	if now.IsZero() {
 		now = time.Now()
 	}
-	if notAfter.IsZero() {
-		notAfter = time.Now()
-	}
 	if now.Before(c.NotBefore) {
 		return x509.CertificateInvalidError{
 			Cert:   c,
 			Reason: x509.Expired,
 			Detail: fmt.Sprintf("current time %s is before %s", now.Format(time.RFC3339), c.NotBefore.Format(time.RFC3339)),
 		}
-	} else if notAfter.After(c.NotAfter) {
+	} else if renewAt := c.NotAfter.Add(-renewBefore); !now.Before(renewAt) {
 		return x509.CertificateInvalidError{
 			Cert:   c,
 			Reason: x509.Expired,
-			Detail: fmt.Sprintf("not after time %s is after %s", notAfter.Format(time.RFC3339), c.NotAfter.Format(time.RFC3339)),
+			Detail: fmt.Sprintf("current time %s is after renewal time %s (expires at %s)",
+				now.Format(time.RFC3339), renewAt.Format(time.RFC3339), c.NotAfter.Format(time.RFC3339)),
 		}
 	}
 	return nil
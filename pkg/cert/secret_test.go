@@ -2,32 +2,52 @@ package cert
 
 import (
 	"context"
+	"crypto/tls"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/mozillazg/pkiutil/pkg/decoder"
 	"github.com/stretchr/testify/assert"
+	errors "golang.org/x/xerrors"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	testingclock "k8s.io/utils/clock/testing"
 )
 
+// FakeSecretInterface keeps one secret and checks resourceVersion like apiserver
 type FakeSecretInterface struct {
 	gotCreateSecret *corev1.Secret
 	getSecret       *corev1.Secret
 	getSecretErr    error
 
 	gotUpdateSecret *corev1.Secret
+	version         int
+	updates         int
 }
 
 func (f *FakeSecretInterface) Create(ctx context.Context, secret *corev1.Secret, opts metav1.CreateOptions) (*corev1.Secret, error) {
-	f.gotCreateSecret = secret
-	return f.gotCreateSecret, nil
+	if f.getSecret != nil {
+		return nil, apierrors.NewAlreadyExists(schema.GroupResource{}, secret.Name)
+	}
+	f.save(secret)
+	f.gotCreateSecret = f.getSecret.DeepCopy()
+	return f.getSecret.DeepCopy(), nil
 }
 
 func (f *FakeSecretInterface) Update(ctx context.Context, secret *corev1.Secret, opts metav1.UpdateOptions) (*corev1.Secret, error) {
-	f.gotUpdateSecret = secret
-	return f.gotUpdateSecret, nil
+	if f.getSecret == nil {
+		return nil, apierrors.NewNotFound(schema.GroupResource{}, secret.Name)
+	}
+	if secret.ResourceVersion != f.getSecret.ResourceVersion {
+		return nil, apierrors.NewConflict(schema.GroupResource{}, secret.Name, nil)
+	}
+	f.updates++
+	f.save(secret)
+	f.gotUpdateSecret = f.getSecret.DeepCopy()
+	return f.getSecret.DeepCopy(), nil
 }
 
 func (f *FakeSecretInterface) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Secret, error) {
@@ -35,18 +55,25 @@ func (f *FakeSecretInterface) Get(ctx context.Context, name string, opts metav1.
 		return nil, f.getSecretErr
 	}
 	if f.getSecret != nil {
-		return f.getSecret, nil
+		return f.getSecret.DeepCopy(), nil
 	}
 	return nil, apierrors.NewNotFound(schema.GroupResource{}, "test")
 }
 
+// save saves secret as the latest version
+func (f *FakeSecretInterface) save(secret *corev1.Secret) {
+	f.version++
+	f.getSecret = secret.DeepCopy()
+	f.getSecret.ResourceVersion = strconv.Itoa(f.version)
+}
+
 func TestCertManager_ensureSecret(t *testing.T) {
 	secretClient := &FakeSecretInterface{}
 	c := certManager{
 		secretInfo: SecretInfo{
 			Name:          "test",
 			Namespace:     "",
-			dontSaveCaKey: true,
+			DontSaveCAKey: true,
 		},
 		certOpt: CertOption{
 			CAName:               "ca",
@@ -70,6 +97,42 @@ func TestCertManager_ensureSecret(t *testing.T) {
 	assert.NotNil(t, s.Data["ca.crt"])
 }
 
+func TestCertManager_ensureSecret_custom_key_names(t *testing.T) {
+	secretClient := &FakeSecretInterface{}
+	c := certManager{
+		secretInfo: SecretInfo{
+			Name:       "test",
+			CACertName: "root.pem",
+			CAKeyName:  "root-key.pem",
+			CertName:   "cert.pem",
+			KeyName:    "key.pem",
+		},
+		certOpt: CertOption{
+			CAName:     "ca",
+			Hosts:      []string{"example.com"},
+			CommonName: "test",
+		},
+		secretClient: secretClient,
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, s.Data, 4)
+	for _, name := range []string{"root.pem", "root-key.pem", "cert.pem", "key.pem"} {
+		assert.NotEmpty(t, s.Data[name])
+	}
+
+	secretClient.getSecret = s.DeepCopy()
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, s, newS)
+	assert.Nil(t, secretClient.gotUpdateSecret)
+
+	delete(secretClient.getSecret.Data, "root-key.pem")
+	err = c.certSecretIsValid(secretClient.getSecret, time.Now())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "missing root-key.pem")
+}
+
 func TestCertManager_ensureSecret_use_exist_secret(t *testing.T) {
 	secretClient := &FakeSecretInterface{}
 	c := certManager{
@@ -128,6 +191,126 @@ func TestCertManager_ensureSecret_update_exist_secret(t *testing.T) {
 	assert.NotEqual(t, s, newS)
 }
 
+func TestCertManager_ensureSecret_renew_server_cert_only(t *testing.T) {
+	secretClient := &FakeSecretInterface{}
+	c := certManager{
+		secretInfo: SecretInfo{
+			Name:      "test",
+			Namespace: "",
+		},
+		certOpt: CertOption{
+			CAName:                     "ca",
+			Hosts:                      []string{"example.com"},
+			CommonName:                 "test",
+			CAValidityDuration:         time.Hour * 24 * 365,
+			ServerCertValidityDuration: time.Hour * 24 * 30,
+		},
+		secretClient: secretClient,
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	ca, err := c.buildArtifactsFromSecret(s)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour*24*365), ca.cert.NotAfter, time.Minute)
+	serverCert, _, err := decoder.DecodePemCert(s.Data["tls.crt"])
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour*24*30), serverCert.NotAfter, time.Minute)
+
+	// replace server cert with an expired one
+	expiredCert, expiredKey, err := c.createCertPEM(ca, time.Now().Add(-time.Hour*2), time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	secretClient.getSecret = s.DeepCopy()
+	secretClient.getSecret.Data["tls.crt"] = expiredCert
+	secretClient.getSecret.Data["tls.key"] = expiredKey
+	secretClient.gotCreateSecret = nil
+
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, newS, secretClient.gotUpdateSecret)
+	assert.Equal(t, s.Data["ca.crt"], newS.Data["ca.crt"])
+	assert.Equal(t, s.Data["ca.key"], newS.Data["ca.key"])
+	assert.NotEqual(t, expiredCert, newS.Data["tls.crt"])
+	assert.NoError(t, c.certSecretIsValid(newS, time.Now()))
+}
+
+func TestCertManager_ensureSecret_renew_all_without_ca_key(t *testing.T) {
+	secretClient := &FakeSecretInterface{}
+	c := certManager{
+		secretInfo: SecretInfo{
+			Name:          "test",
+			Namespace:     "",
+			DontSaveCAKey: true,
+		},
+		certOpt: CertOption{
+			CAName:     "ca",
+			Hosts:      []string{"example.com"},
+			CommonName: "test",
+		},
+		secretClient: secretClient,
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+
+	secretClient.getSecret = s.DeepCopy()
+	delete(secretClient.getSecret.Data, "tls.crt")
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, newS, secretClient.gotUpdateSecret)
+	assert.NotEqual(t, s.Data["ca.crt"], newS.Data["ca.crt"])
+}
+
+func TestCertManager_newServerCertPEM_not_outlive_ca(t *testing.T) {
+	c := certManager{
+		certOpt: CertOption{
+			CAName:                     "ca",
+			Hosts:                      []string{"example.com"},
+			CommonName:                 "test",
+			ServerCertValidityDuration: time.Hour * 24 * 365,
+		},
+	}
+	ca, err := c.createCACert(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	cert, _, err := c.newServerCertPEM(ca)
+	assert.NoError(t, err)
+	serverCert, _, err := decoder.DecodePemCert(cert)
+	assert.NoError(t, err)
+	assert.Equal(t, ca.cert.NotAfter, serverCert.NotAfter)
+}
+
+func TestCertManager_ensureSecret_key_algorithm(t *testing.T) {
+	for _, alg := range []KeyAlgorithm{ECDSAP256, ECDSAP384, Ed25519} {
+		t.Run(string(alg), func(t *testing.T) {
+			secretClient := &FakeSecretInterface{}
+			c := certManager{
+				secretInfo: SecretInfo{
+					Name:      "test",
+					Namespace: "",
+				},
+				certOpt: CertOption{
+					CAName:       "ca",
+					Hosts:        []string{"example.com"},
+					CommonName:   "test",
+					KeyAlgorithm: alg,
+				},
+				secretClient: secretClient,
+			}
+			s, err := c.ensureSecret(context.TODO())
+			assert.NoError(t, err)
+			assert.Equal(t, s, secretClient.gotCreateSecret)
+
+			_, err = tls.X509KeyPair(s.Data["tls.crt"], s.Data["tls.key"])
+			assert.NoError(t, err)
+			assert.NoError(t, c.certSecretIsValid(s, time.Now()))
+
+			secretClient.getSecret = s
+			secretClient.gotCreateSecret = nil
+			newS, err := c.ensureSecret(context.TODO())
+			assert.NoError(t, err)
+			assert.Equal(t, s, newS)
+		})
+	}
+}
+
 func Test_certManager_certSecretIsValid(t *testing.T) {
 	secretClient := &FakeSecretInterface{}
 	c := certManager{
@@ -231,8 +414,7 @@ func Test_certManager_certSecretIsValid(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &certManager{}
-			err := c.certSecretIsValid(tt.args.secret, tt.args.now, tt.args.now)
+			err := c.certSecretIsValid(tt.args.secret, tt.args.now)
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -241,3 +423,357 @@ func Test_certManager_certSecretIsValid(t *testing.T) {
 		})
 	}
 }
+
+func TestCertManager_ensureSecret_renew_before(t *testing.T) {
+	tests := []struct {
+		name      string
+		certOpt   CertOption
+		notRenew  time.Duration
+		renewAt   time.Duration
+		renewAll  bool
+		serverTTL time.Duration
+	}{
+		{
+			name: "default",
+			certOpt: CertOption{
+				CertValidityDuration: time.Hour * 24 * 30,
+				CAPropagationDelay:   -1,
+			},
+			notRenew: time.Hour * 24 * 22,
+			renewAt:  time.Hour*24*23 + time.Minute*5,
+			renewAll: true,
+		},
+		{
+			name: "RenewBefore",
+			certOpt: CertOption{
+				CAValidityDuration:         time.Hour * 24 * 365,
+				ServerCertValidityDuration: time.Hour * 24 * 30,
+				RenewBefore:                time.Hour * 24 * 10,
+			},
+			notRenew: time.Hour * 24 * 19,
+			renewAt:  time.Hour*24*20 + time.Minute*5,
+		},
+		{
+			name: "RenewBeforePercentage",
+			certOpt: CertOption{
+				CAValidityDuration:         time.Hour * 24 * 365,
+				ServerCertValidityDuration: time.Hour*24*10 - time.Hour,
+				RenewBefore:                time.Hour * 24 * 30,
+				RenewBeforePercentage:      50,
+			},
+			notRenew: time.Hour * 24 * 4,
+			renewAt:  time.Hour*24*5 + time.Minute*5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeClock := testingclock.NewFakePassiveClock(time.Now())
+			secretClient := &FakeSecretInterface{}
+			tt.certOpt.CAName = "ca"
+			tt.certOpt.Hosts = []string{"example.com"}
+			tt.certOpt.CommonName = "test"
+			c := certManager{
+				secretInfo: SecretInfo{
+					Name: "test",
+				},
+				certOpt:      tt.certOpt,
+				secretClient: secretClient,
+				clock:        fakeClock,
+			}
+			s, err := c.ensureSecret(context.TODO())
+			assert.NoError(t, err)
+			secretClient.getSecret = s.DeepCopy()
+
+			start := fakeClock.Now()
+			fakeClock.SetTime(start.Add(tt.notRenew))
+			newS, err := c.ensureSecret(context.TODO())
+			assert.NoError(t, err)
+			assert.Equal(t, s, newS)
+			assert.Nil(t, secretClient.gotUpdateSecret)
+
+			fakeClock.SetTime(start.Add(tt.renewAt))
+			newS, err = c.ensureSecret(context.TODO())
+			assert.NoError(t, err)
+			assert.NotNil(t, secretClient.gotUpdateSecret)
+			assert.NotEqual(t, string(s.Data["tls.crt"]), string(newS.Data["tls.crt"]))
+			if tt.renewAll {
+				assert.NotEqual(t, string(s.Data["ca.crt"]), string(newS.Data["ca.crt"]))
+			} else {
+				assert.Equal(t, string(s.Data["ca.crt"]), string(newS.Data["ca.crt"]))
+			}
+			assert.NoError(t, c.certSecretIsValid(newS, fakeClock.Now()))
+		})
+	}
+}
+
+func Test_certManager_nextRenewTime(t *testing.T) {
+	c := &certManager{
+		certOpt: CertOption{
+			CAName:                     "ca",
+			Hosts:                      []string{"example.com"},
+			CommonName:                 "test",
+			CAValidityDuration:         time.Hour * 24 * 365,
+			ServerCertValidityDuration: time.Hour * 24 * 30,
+			RenewBefore:                time.Hour * 24,
+		},
+	}
+	secret, err := c.newSecret()
+	assert.NoError(t, err)
+	renewAt, err := c.nextRenewTime(secret)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour*24*29), renewAt, time.Minute)
+
+	_, err = c.nextRenewTime(&corev1.Secret{})
+	assert.Error(t, err)
+}
+
+func Test_mergeCAPemCerts_retention(t *testing.T) {
+	c := &certManager{certOpt: CertOption{CAName: "ca", CommonName: "test"}}
+	now := time.Now()
+	newCA := func(begin, end time.Time) *keyPairArtifacts {
+		ca, err := c.createCACert(begin, end)
+		assert.NoError(t, err)
+		return ca
+	}
+	current := newCA(now.Add(-time.Hour), now.Add(time.Hour))
+	old1 := newCA(now.Add(-time.Hour), now.Add(time.Hour))
+	old2 := newCA(now.Add(-time.Hour), now.Add(time.Hour))
+	expired := newCA(now.Add(-time.Hour*2), now.Add(-time.Hour))
+	nonCA, _, err := c.createCertPEM(current, now.Add(-time.Hour), now.Add(time.Hour))
+	assert.NoError(t, err)
+	bundle := func(pems ...[]byte) []byte {
+		var b []byte
+		for _, p := range pems {
+			b = appendPEM(b, p)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name        string
+		old         []byte
+		retention   CABundleRetention
+		wantChanged bool
+		want        []byte
+	}{
+		{
+			name:        "default keep one old cert",
+			old:         bundle(old1.certPEM, old2.certPEM),
+			wantChanged: true,
+			want:        bundle(current.certPEM, old1.certPEM),
+		},
+		{
+			name:        "keep two old certs",
+			old:         bundle(old1.certPEM, old2.certPEM),
+			retention:   CABundleRetention{MaxPreviousCAs: 2},
+			wantChanged: true,
+			want:        bundle(current.certPEM, old1.certPEM, old2.certPEM),
+		},
+		{
+			name:        "keep no old cert",
+			old:         bundle(current.certPEM, old1.certPEM),
+			retention:   CABundleRetention{MaxPreviousCAs: -1},
+			wantChanged: true,
+			want:        bundle(current.certPEM),
+		},
+		{
+			name:        "not changed",
+			old:         bundle(old1.certPEM, current.certPEM),
+			retention:   CABundleRetention{MaxPreviousCAs: 2},
+			wantChanged: false,
+			want:        bundle(old1.certPEM, current.certPEM),
+		},
+		{
+			name:        "keep expired and non-CA certs",
+			old:         bundle(expired.certPEM, nonCA),
+			retention:   CABundleRetention{MaxPreviousCAs: 2},
+			wantChanged: true,
+			want:        bundle(current.certPEM, expired.certPEM, nonCA),
+		},
+		{
+			name:        "prune expired certs",
+			old:         bundle(expired.certPEM, old1.certPEM),
+			retention:   CABundleRetention{PruneExpired: true},
+			wantChanged: true,
+			want:        bundle(current.certPEM, old1.certPEM),
+		},
+		{
+			name:        "prune non-CA certs",
+			old:         bundle(current.certPEM, nonCA),
+			retention:   CABundleRetention{PruneNonCA: true},
+			wantChanged: true,
+			want:        bundle(current.certPEM),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, certs := mergeCAPemCerts(tt.old, current.certPEM, nil, tt.retention)
+			assert.Equal(t, tt.wantChanged, changed)
+			assert.Equal(t, string(tt.want), string(certs))
+		})
+	}
+}
+
+func TestCertManager_ensureSecret_options_changed(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(opt *CertOption)
+		rotateCA bool
+		// only the CA is issued with the changed options
+		caOnly bool
+	}{
+		{
+			name:   "add host",
+			change: func(opt *CertOption) { opt.Hosts = append(opt.Hosts, "test.default.svc", "127.0.0.1") },
+		},
+		{
+			name:   "remove host",
+			change: func(opt *CertOption) { opt.Hosts = opt.Hosts[:1] },
+		},
+		{
+			name:   "common name",
+			change: func(opt *CertOption) { opt.CommonName = "new" },
+		},
+		{
+			name:     "organizations",
+			change:   func(opt *CertOption) { opt.Organizations = []string{"org"} },
+			rotateCA: true,
+		},
+		{
+			name:     "rsa key size",
+			change:   func(opt *CertOption) { opt.RSAKeySize = 3072 },
+			rotateCA: true,
+		},
+		{
+			name:     "key algorithm",
+			change:   func(opt *CertOption) { opt.KeyAlgorithm = ECDSAP256 },
+			rotateCA: true,
+		},
+		{
+			name:     "ca name",
+			change:   func(opt *CertOption) { opt.CAName = "new-ca" },
+			rotateCA: true,
+			caOnly:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeClock := testingclock.NewFakePassiveClock(time.Now())
+			secretClient := &FakeSecretInterface{}
+			c := &certManager{
+				secretInfo: SecretInfo{Name: "test"},
+				certOpt: CertOption{
+					Hosts:      []string{"example.com", "test.example.com"},
+					CommonName: "test",
+				},
+				secretClient: secretClient,
+				clock:        fakeClock,
+			}
+			s, err := c.ensureSecret(context.TODO())
+			assert.NoError(t, err)
+			_, err = c.ensureSecret(context.TODO())
+			assert.NoError(t, err)
+			assert.Equal(t, 0, secretClient.updates)
+
+			tt.change(&c.certOpt)
+			newS, err := c.ensureSecret(context.TODO())
+			assert.NoError(t, err)
+			assert.Equal(t, 1, secretClient.updates)
+			assert.NoError(t, c.serverCertIsValid(newS, fakeClock.Now()))
+			assert.NoError(t, c.verifyServerCertChain(newS, fakeClock.Now()))
+			// the server cert is issued by the existing CA
+			assert.Equal(t, s.Data["ca.crt"], newS.Data["ca.crt"])
+			if !tt.caOnly {
+				assert.NotEqual(t, s.Data["tls.crt"], newS.Data["tls.crt"])
+			}
+			if !tt.rotateCA {
+				assert.NoError(t, c.certSecretIsValid(newS, fakeClock.Now()))
+				assert.Nil(t, newS.Data[nextCACertName])
+				return
+			}
+
+			// the CA is rotated in phases
+			var invalidErr *InvalidCertError
+			assert.True(t, errors.As(c.certSecretIsValid(newS, fakeClock.Now()), &invalidErr))
+			assert.Equal(t, CertOptionsChanged, invalidErr.Reason)
+			nextCA := newS.Data[nextCACertName]
+			assert.NotEmpty(t, nextCA)
+			newS, err = c.markCAPublished(context.TODO(), newS)
+			assert.NoError(t, err)
+			fakeClock.SetTime(fakeClock.Now().Add(c.certOpt.getCAPropagationDelay() + time.Second))
+			newS, err = c.ensureSecret(context.TODO())
+			assert.NoError(t, err)
+			assert.NoError(t, c.certSecretIsValid(newS, fakeClock.Now()))
+			assert.Equal(t, nextCA, newS.Data["ca.crt"])
+			assert.Equal(t, s.Data["ca.crt"], newS.Data[previousCACertName])
+		})
+	}
+}
+
+// racingSecretStore runs race before the first Create or Update, e.g. another replica saves the secret
+type racingSecretStore struct {
+	*FakeSecretInterface
+	race func()
+}
+
+func (r *racingSecretStore) runRace() {
+	if race := r.race; race != nil {
+		r.race = nil
+		race()
+	}
+}
+
+func (r *racingSecretStore) Create(ctx context.Context, secret *corev1.Secret, opts metav1.CreateOptions) (*corev1.Secret, error) {
+	r.runRace()
+	return r.FakeSecretInterface.Create(ctx, secret, opts)
+}
+
+func (r *racingSecretStore) Update(ctx context.Context, secret *corev1.Secret, opts metav1.UpdateOptions) (*corev1.Secret, error) {
+	r.runRace()
+	return r.FakeSecretInterface.Update(ctx, secret, opts)
+}
+
+func TestCertManager_ensureSecret_multiple_replicas(t *testing.T) {
+	store := &FakeSecretInterface{}
+	newReplica := func() (*certManager, *racingSecretStore) {
+		client := &racingSecretStore{FakeSecretInterface: store}
+		return &certManager{
+			secretInfo: SecretInfo{Name: "test"},
+			certOpt: CertOption{
+				Hosts:        []string{"example.com"},
+				CommonName:   "test",
+				KeyAlgorithm: ECDSAP256,
+			},
+			secretClient: client,
+		}, client
+	}
+
+	// both replicas see that the secret is not found, the slower one uses the secret created by the faster one
+	a, _ := newReplica()
+	b, bClient := newReplica()
+	var aSecret *corev1.Secret
+	bClient.race = func() {
+		var err error
+		aSecret, err = a.ensureSecret(context.TODO())
+		assert.NoError(t, err)
+	}
+	bSecret, err := b.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, aSecret.Data, bSecret.Data)
+	assert.Equal(t, aSecret.Data, store.getSecret.Data)
+	assert.Equal(t, 0, store.updates)
+
+	// both replicas see that the secret is invalid, only one of them updates the secret
+	store.getSecret.Data["tls.crt"] = []byte("xxx")
+	store.save(store.getSecret)
+	bClient.race = func() {
+		var err error
+		aSecret, err = a.ensureSecret(context.TODO())
+		assert.NoError(t, err)
+	}
+	bSecret, err = b.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, aSecret.Data, bSecret.Data)
+	assert.Equal(t, aSecret.Data, store.getSecret.Data)
+	assert.Equal(t, 1, store.updates)
+}
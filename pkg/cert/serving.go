@@ -0,0 +1,85 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"time"
+
+	errors "golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+)
+
+// the secret may be renewed by other replicas, it is read again at this interval
+const servingCertReloadInterval = time.Second * 10
+
+// GetCertificate returns the server cert of the secret, it can be used as tls.Config.GetCertificate
+// to serve the server cert without mounting the secret to CertDir, see CertOption.ServeFromSecret.
+// the server cert is loaded by EnsureCertReady and it is replaced once it is renewed, the secret
+// is also read every 10 seconds in WatchAndEnsureWebhooksCA to load the cert renewed by other replicas.
+func (w *WebhookCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.servingCertMu.RLock()
+	defer w.servingCertMu.RUnlock()
+	if w.servingCert == nil {
+		return nil, errors.New("server cert is not loaded from secret yet")
+	}
+	return w.servingCert, nil
+}
+
+// setServingCert loads the server cert of secret for GetCertificate
+func (w *WebhookCert) setServingCert(secret *corev1.Secret) error {
+	info := w.certmanager.secretInfo
+	certPEM, keyPEM := secret.Data[info.getCertName()], secret.Data[info.getKeyName()]
+	w.servingCertMu.RLock()
+	loaded := w.servingCert != nil && bytes.Equal(certPEM, w.servingCertPEM) && bytes.Equal(keyPEM, w.servingKeyPEM)
+	w.servingCertMu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return errors.Errorf("load server cert from secret %s: %w", info.Name, err)
+	}
+	w.servingCertMu.Lock()
+	defer w.servingCertMu.Unlock()
+	w.servingCert = &cert
+	w.servingCertPEM = certPEM
+	w.servingKeyPEM = keyPEM
+	return nil
+}
+
+// reloadServingCertPeriodically loads the server cert of the secret until ctx is done,
+// then the cert renewed by other replicas is served before CA rotation drops the old CA
+func (w *WebhookCert) reloadServingCertPeriodically(ctx context.Context) {
+	wait.JitterUntilWithContext(ctx, func(ctx context.Context) {
+		if err := w.reloadServingCert(ctx); err != nil {
+			klog.Errorf("reload server cert from secret failed: %+v", err)
+		}
+	}, servingCertReloadInterval, 0.1, false)
+}
+
+func (w *WebhookCert) reloadServingCert(ctx context.Context) error {
+	secret, err := w.certmanager.readSecret(ctx)
+	if err != nil {
+		return errors.Errorf("get secret: %w", err)
+	}
+	return w.setServingCert(secret)
+}
+
+// currentServerCert returns the server cert which should be served by the webhook server
+func (w *WebhookCert) currentServerCert() (*tls.Certificate, error) {
+	if w.certOpt.ServeFromSecret {
+		return w.GetCertificate(nil)
+	}
+	if watcher := w.getCertWatcher(); watcher != nil {
+		return watcher.GetCertificate(nil)
+	}
+	cert, err := tls.LoadX509KeyPair(w.certOpt.getServerCertPath(), w.certOpt.getServerKeyPath())
+	if err != nil {
+		return nil, errors.Errorf("load server cert from %s: %w", w.certOpt.CertDir, err)
+	}
+	return &cert, nil
+}
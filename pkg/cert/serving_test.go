@@ -0,0 +1,112 @@
+package cert
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookCert_GetCertificate(t *testing.T) {
+	certOpt := CertOption{
+		Hosts:           []string{"127.0.0.1"},
+		CommonName:      "test",
+		KeyAlgorithm:    ECDSAP256,
+		ServeFromSecret: true,
+		SecretInfo:      SecretInfo{Name: "test"},
+	}
+	secretClient := &FakeSecretInterface{}
+	w := &WebhookCert{
+		certOpt: certOpt,
+		certmanager: &certManager{
+			secretInfo:   certOpt.SecretInfo,
+			certOpt:      certOpt,
+			secretClient: secretClient,
+		},
+		webhookmanager: &webhookManager{},
+		checkerClient: &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		}},
+	}
+	_, err := w.GetCertificate(nil)
+	assert.Error(t, err)
+
+	// the secret is not mounted to CertDir
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+	assert.NoError(t, w.EnsureCertReady(ctx))
+	cert, err := w.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Certificate[0], decodePEMCerts(secretClient.getSecret.Data["tls.crt"]).Certificate[0])
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	s.Listener = tls.NewListener(s.Listener, &tls.Config{GetCertificate: w.GetCertificate})
+	s.Start()
+	defer s.Close()
+	addr := s.Listener.Addr().String()
+	assert.NoError(t, w.CheckServerCertValid(context.TODO(), addr))
+
+	// the renewed server cert is served at once
+	w.certOpt.Hosts = append(w.certOpt.Hosts, "example.com")
+	w.certmanager.certOpt = w.certOpt
+	_, err = w.ensureCert(context.TODO())
+	assert.NoError(t, err)
+	newCert, err := w.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, cert.Certificate[0], newCert.Certificate[0])
+	assert.NoError(t, w.CheckServerCertValid(context.TODO(), addr))
+}
+
+func TestWebhookCert_GetCertificate_renewed_by_other_replica(t *testing.T) {
+	certOpt := CertOption{
+		Hosts:           []string{"example.com"},
+		CommonName:      "test",
+		KeyAlgorithm:    ECDSAP256,
+		ServeFromSecret: true,
+		SecretInfo:      SecretInfo{Name: "test"},
+	}
+	store := &FakeSecretInterface{}
+	w := &WebhookCert{
+		certOpt: certOpt,
+		certmanager: &certManager{
+			secretInfo:   certOpt.SecretInfo,
+			certOpt:      certOpt,
+			secretClient: store,
+		},
+		webhookmanager: &webhookManager{},
+	}
+	_, err := w.ensureCert(context.TODO())
+	assert.NoError(t, err)
+	cert, err := w.GetCertificate(nil)
+	assert.NoError(t, err)
+
+	// another replica renews the server cert in the same secret
+	other := &certManager{
+		secretInfo:   certOpt.SecretInfo,
+		certOpt:      certOpt,
+		secretClient: store,
+	}
+	other.certOpt.Hosts = append(other.certOpt.Hosts, "other.example.com")
+	otherS, err := other.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, store.updates)
+
+	assert.NoError(t, w.reloadServingCert(context.TODO()))
+	newCert, err := w.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, cert.Certificate[0], newCert.Certificate[0])
+	assert.Equal(t, decodePEMCerts(otherS.Data["tls.crt"]).Certificate[0], newCert.Certificate[0])
+
+	// the cert is not loaded again when the secret is not changed
+	assert.NoError(t, w.reloadServingCert(context.TODO()))
+	sameCert, err := w.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.True(t, newCert == sameCert)
+}
@@ -0,0 +1,240 @@
+package cert
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	errors "golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// SecretStore saves cert material, the Secret client of client-go is the default implementation.
+// Other implementations should keep the semantics of the Secret client:
+//
+//   - Get returns a NotFound error of k8s.io/apimachinery/pkg/api/errors if the secret does not exist.
+//   - Create returns an AlreadyExists error if the secret exists.
+//   - Update returns a Conflict error if ResourceVersion of the secret is not the latest one,
+//     and ResourceVersion is changed after every successful Create and Update.
+type SecretStore interface {
+	Create(ctx context.Context, secret *corev1.Secret, opts metav1.CreateOptions) (*corev1.Secret, error)
+	Update(ctx context.Context, secret *corev1.Secret, opts metav1.UpdateOptions) (*corev1.Secret, error)
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Secret, error)
+}
+
+var secretResource = schema.GroupResource{Resource: "secrets"}
+
+type configMapStore struct {
+	client typedcorev1.ConfigMapInterface
+}
+
+// NewConfigMapStore returns a SecretStore which saves data to ConfigMaps.
+// ConfigMap is not protected like Secret, it is meant for data which is not sensitive,
+// e.g. the CA secret when SecretInfo.DontSaveCAKey is true.
+func NewConfigMapStore(client typedcorev1.ConfigMapInterface) SecretStore {
+	return &configMapStore{client: client}
+}
+
+func (s *configMapStore) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Secret, error) {
+	cm, err := s.client.Get(ctx, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return configMapToSecret(cm), nil
+}
+
+func (s *configMapStore) Create(ctx context.Context, secret *corev1.Secret, opts metav1.CreateOptions) (*corev1.Secret, error) {
+	cm, err := s.client.Create(ctx, secretToConfigMap(secret), opts)
+	if err != nil {
+		return nil, err
+	}
+	return configMapToSecret(cm), nil
+}
+
+func (s *configMapStore) Update(ctx context.Context, secret *corev1.Secret, opts metav1.UpdateOptions) (*corev1.Secret, error) {
+	cm, err := s.client.Update(ctx, secretToConfigMap(secret), opts)
+	if err != nil {
+		return nil, err
+	}
+	return configMapToSecret(cm), nil
+}
+
+func secretToConfigMap(secret *corev1.Secret) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: *secret.ObjectMeta.DeepCopy(),
+		BinaryData: map[string][]byte{},
+	}
+	for k, v := range secret.Data {
+		cm.BinaryData[k] = v
+	}
+	return cm
+}
+
+func configMapToSecret(cm *corev1.ConfigMap) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: *cm.ObjectMeta.DeepCopy(),
+		Data:       map[string][]byte{},
+	}
+	for k, v := range cm.Data {
+		secret.Data[k] = []byte(v)
+	}
+	for k, v := range cm.BinaryData {
+		secret.Data[k] = v
+	}
+	return secret
+}
+
+const dirStoreMetadataName = ".webhookcert-metadata.json"
+
+type dirStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+type dirStoreMetadata struct {
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// NewDirStore returns a SecretStore which saves data to local files, it is meant for development.
+// The data of a secret is saved to the files in dir/<secret name>, which can be used as CertDir.
+func NewDirStore(dir string) SecretStore {
+	return &dirStore{dir: dir}
+}
+
+func (s *dirStore) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Secret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(name)
+}
+
+func (s *dirStore) Create(ctx context.Context, secret *corev1.Secret, opts metav1.CreateOptions) (*corev1.Secret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.read(secret.Name); err == nil {
+		return nil, apierrors.NewAlreadyExists(secretResource, secret.Name)
+	} else if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	return s.write(secret, 1)
+}
+
+func (s *dirStore) Update(ctx context.Context, secret *corev1.Secret, opts metav1.UpdateOptions) (*corev1.Secret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := s.read(secret.Name)
+	if err != nil {
+		return nil, err
+	}
+	if secret.ResourceVersion != current.ResourceVersion {
+		return nil, apierrors.NewConflict(secretResource, secret.Name,
+			errors.New("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+	version, _ := strconv.Atoi(current.ResourceVersion)
+	return s.write(secret, version+1)
+}
+
+func (s *dirStore) read(name string) (*corev1.Secret, error) {
+	dir := filepath.Join(s.dir, name)
+	data, err := ioutil.ReadFile(filepath.Join(dir, dirStoreMetadataName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, apierrors.NewNotFound(secretResource, name)
+		}
+		return nil, errors.Errorf("read metadata of %s: %w", name, err)
+	}
+	var metadata dirStoreMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, errors.Errorf("parse metadata of %s: %w", name, err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			ResourceVersion: metadata.ResourceVersion,
+			Labels:          metadata.Labels,
+			Annotations:     metadata.Annotations,
+		},
+		Data: map[string][]byte{},
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Errorf("read dir %s: %w", dir, err)
+	}
+	for _, f := range files {
+		if !f.Mode().IsRegular() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		v, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, errors.Errorf("read file %s: %w", f.Name(), err)
+		}
+		secret.Data[f.Name()] = v
+	}
+	return secret, nil
+}
+
+// write saves the data files first and then the metadata file, so that
+// the secret is not found if it is not created completely
+func (s *dirStore) write(secret *corev1.Secret, version int) (*corev1.Secret, error) {
+	dir := filepath.Join(s.dir, secret.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Errorf("create dir %s: %w", dir, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Errorf("read dir %s: %w", dir, err)
+	}
+	for _, f := range files {
+		if _, ok := secret.Data[f.Name()]; !ok && f.Mode().IsRegular() && !strings.HasPrefix(f.Name(), ".") {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return nil, errors.Errorf("remove file %s: %w", f.Name(), err)
+			}
+		}
+	}
+	for k, v := range secret.Data {
+		if err := writeFileAtomically(filepath.Join(dir, k), v); err != nil {
+			return nil, err
+		}
+	}
+	metadata, err := json.Marshal(dirStoreMetadata{
+		ResourceVersion: strconv.Itoa(version),
+		Labels:          secret.Labels,
+		Annotations:     secret.Annotations,
+	})
+	if err != nil {
+		return nil, errors.Errorf("encode metadata of %s: %w", secret.Name, err)
+	}
+	if err := writeFileAtomically(filepath.Join(dir, dirStoreMetadataName), metadata); err != nil {
+		return nil, err
+	}
+	return s.read(secret.Name)
+}
+
+func writeFileAtomically(name string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return errors.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.Errorf("write file %s: %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Errorf("write file %s: %w", name, err)
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return errors.Errorf("write file %s: %w", name, err)
+	}
+	return nil
+}
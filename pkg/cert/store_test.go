@@ -0,0 +1,125 @@
+package cert
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testSecretStore(t *testing.T, store SecretStore) {
+	ctx := context.TODO()
+	_, err := store.Get(ctx, "test", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test",
+			Namespace:   "default",
+			Annotations: map[string]string{"foo": "bar"},
+		},
+		Data: map[string][]byte{"ca.crt": []byte("ca"), "tls.crt": []byte("cert")},
+	}
+	created, err := store.Create(ctx, secret, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, created.Data)
+	assert.Equal(t, "bar", created.Annotations["foo"])
+	assert.NotEmpty(t, created.ResourceVersion)
+	_, err = store.Create(ctx, secret, metav1.CreateOptions{})
+	assert.True(t, apierrors.IsAlreadyExists(err))
+
+	got, err := store.Get(ctx, "test", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, created.Data, got.Data)
+	assert.Equal(t, created.ResourceVersion, got.ResourceVersion)
+
+	got.Data = map[string][]byte{"ca.crt": []byte("new ca")}
+	updated, err := store.Update(ctx, got, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, got.Data, updated.Data)
+	assert.NotEqual(t, created.ResourceVersion, updated.ResourceVersion)
+
+	// update with a stale resourceVersion
+	created.Data = map[string][]byte{"ca.crt": []byte("stale")}
+	_, err = store.Update(ctx, created, metav1.UpdateOptions{})
+	assert.True(t, apierrors.IsConflict(err))
+
+	got, err = store.Get(ctx, "test", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"ca.crt": []byte("new ca")}, got.Data)
+}
+
+func TestDirStore(t *testing.T) {
+	dir := t.TempDir()
+	testSecretStore(t, NewDirStore(dir))
+
+	// data is saved to files which can be used as CertDir
+	data, err := ioutil.ReadFile(path.Join(dir, "test", "ca.crt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new ca", string(data))
+	_, err = ioutil.ReadFile(path.Join(dir, "test", "tls.crt"))
+	assert.Error(t, err)
+}
+
+func TestConfigMapStore(t *testing.T) {
+	ctx := context.TODO()
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: "default"},
+		Data:       map[string]string{"ca.crt": "ca"},
+	})
+	store := NewConfigMapStore(client.CoreV1().ConfigMaps("default"))
+
+	// resourceVersion is checked by apiserver, the fake client only keeps the data
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Data:       map[string][]byte{"ca.crt": []byte("ca")},
+	}
+	_, err := store.Create(ctx, secret, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	_, err = store.Create(ctx, secret, metav1.CreateOptions{})
+	assert.True(t, apierrors.IsAlreadyExists(err))
+	got, err := store.Get(ctx, "test", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, got.Data)
+	got.Data["ca.key"] = []byte("key")
+	_, err = store.Update(ctx, got, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	cm, err := client.CoreV1().ConfigMaps("default").Get(ctx, "test", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"ca.crt": []byte("ca"), "ca.key": []byte("key")}, cm.BinaryData)
+
+	// data of a ConfigMap created by others
+	got, err = store.Get(ctx, "existing", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"ca.crt": []byte("ca")}, got.Data)
+	_, err = store.Get(ctx, "missing", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestCertManager_ensureSecret_dir_store(t *testing.T) {
+	dir := t.TempDir()
+	c := &certManager{
+		secretInfo:     SecretInfo{Name: "test"},
+		certOpt:        CertOption{Hosts: []string{"example.com"}, CommonName: "test"},
+		secretClient:   NewDirStore(dir),
+		caSecretInfo:   SecretInfo{Name: "test-ca"},
+		caSecretClient: NewDirStore(dir),
+	}
+	s, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, c.certSecretIsValid(s, c.now()))
+
+	newS, err := c.ensureSecret(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, s.Data, newS.Data)
+	_, err = ioutil.ReadFile(path.Join(dir, "test-ca", "ca.key"))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadFile(path.Join(dir, "test", "ca.key"))
+	assert.Error(t, err)
+}
@@ -3,7 +3,11 @@ package cert
 import (
 	"bytes"
 	"context"
+	"crypto/x509"
 	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	errors "golang.org/x/xerrors"
@@ -11,6 +15,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
@@ -25,11 +30,57 @@ const (
 	ValidatingV1Beta1 WebhookType = "ValidatingV1Beta1"
 	MutatingV1        WebhookType = "MutatingV1"
 	MutatingV1Beta1   WebhookType = "MutatingV1Beta1"
+	// conversion webhook of a CustomResourceDefinition, caBundle of
+	// spec.conversion.webhook.clientConfig is patched
+	CRDConversionV1 WebhookType = "CRDConversionV1"
+	// APIService of an aggregated API server, spec.caBundle is patched
+	APIServiceV1 WebhookType = "APIServiceV1"
 )
 
 type WebhookInfo struct {
 	Type WebhookType
 	Name string
+	// resource which carries caBundle, e.g. a custom resource of Istio or Gatekeeper,
+	// Type is ignored if it is set
+	Resource *schema.GroupVersionResource
+	// paths of the caBundle fields in Resource, fields are separated by `.`,
+	// `[*]` matches all items of a list, e.g. `webhooks[*].clientConfig.caBundle`, `spec.caBundle`.
+	// required if Resource is set
+	CABundlePaths []string
+	// label selector of the resources to patch, e.g. `app.kubernetes.io/instance=my-release`,
+	// all resources of Type or Resource which match it are patched and Name is ignored.
+	// resources which are created later are patched when they are watched
+	LabelSelector string
+	// only the webhooks whose clientConfig matches it are patched, default: all webhooks are patched.
+	// the conversion webhook of CRDConversionV1 and spec.service of APIServiceV1 are matched too,
+	// it is not supported with Resource
+	ClientConfigFilter *ClientConfigFilter
+}
+
+// ClientConfigFilter matches clientConfig of a webhook by its service or url,
+// a webhook matches if either of them matches
+type ClientConfigFilter struct {
+	// name of clientConfig.service
+	ServiceName string
+	// namespace of clientConfig.service, default: any namespace
+	ServiceNamespace string
+	// port of clientConfig.service, default: any port. the port is 443 if it is not set in clientConfig
+	ServicePort int32
+	// host of clientConfig.url, e.g. `webhook.example.com` or `webhook.example.com:8443`
+	URLHost string
+}
+
+// CABundleRetention controls which old certs are kept when merging caBundle
+type CABundleRetention struct {
+	// max number of old certs kept in caBundle besides the current CA certs, default: 1.
+	// negative value means no old cert is kept. by default the previous CA replaced by
+	// the CA rotation is dropped after CAPropagationDelay, it is kept as an old cert
+	// when MaxPreviousCAs is set to a positive value
+	MaxPreviousCAs int
+	// remove expired certs from caBundle
+	PruneExpired bool
+	// remove certs which are not CA from caBundle
+	PruneNonCA bool
 }
 
 type resourceClientGetter func(resource schema.GroupVersionResource) resourceInterface
@@ -37,45 +88,52 @@ type resourceClientGetter func(resource schema.GroupVersionResource) resourceInt
 type resourceInterface interface {
 	Get(ctx context.Context, name string, options metav1.GetOptions, subresources ...string) (*unstructured.Unstructured, error)
 	Update(ctx context.Context, obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error)
+	List(ctx context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error)
 	Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
 }
 
 type webhookManager struct {
 	webhooks             []WebhookInfo
+	caBundleRetention    CABundleRetention
 	resourceClientGetter resourceClientGetter
 }
 
-func newWebhookManager(webhooks []WebhookInfo, dyclient dynamic.Interface) *webhookManager {
+func newWebhookManager(webhooks []WebhookInfo, retention CABundleRetention, dyclient dynamic.Interface) *webhookManager {
 	return &webhookManager{
-		webhooks: webhooks,
+		webhooks:          webhooks,
+		caBundleRetention: retention,
 		resourceClientGetter: func(resource schema.GroupVersionResource) resourceInterface {
 			return dyclient.Resource(resource)
 		},
 	}
 }
 
-func (w *webhookManager) ensureCA(ctx context.Context, caPem []byte) error {
+// ensureCA merges caPem into caBundle of webhooks and removes untrustedPem from it
+func (w *webhookManager) ensureCA(ctx context.Context, caPem, untrustedPem []byte) error {
 	for _, info := range w.webhooks {
 
 		err := retry.OnError(retry.DefaultBackoff, func(err error) bool {
 			return err != nil
 		}, func() error {
-			return w.ensureWebhookCA(ctx, info, caPem)
+			return w.ensureWebhookCA(ctx, info, caPem, untrustedPem)
 		})
 
 		if err != nil {
-			return errors.Errorf("ensure ca for webhook %s: %w", info.Name, err)
+			return errors.Errorf("ensure ca for webhook %s: %w", info.displayName(), err)
 		}
 	}
 	return nil
 }
 
-func (w *webhookManager) ensureWebhookCA(ctx context.Context, info WebhookInfo, caPem []byte) error {
-	gvs, err := info.Type.gvr()
+func (w *webhookManager) ensureWebhookCA(ctx context.Context, info WebhookInfo, caPem, untrustedPem []byte) error {
+	gvs, err := info.gvr()
 	if err != nil {
 		return errors.Errorf(": %w", err)
 	}
 	client := w.resourceClientGetter(*gvs)
+	if info.LabelSelector != "" {
+		return w.ensureSelectedWebhooksCA(ctx, client, info, caPem, untrustedPem)
+	}
 	obj, err := client.Get(ctx, info.Name, metav1.GetOptions{})
 	if err != nil {
 		if apierrors.IsNotFound(err) {
@@ -84,43 +142,80 @@ func (w *webhookManager) ensureWebhookCA(ctx context.Context, info WebhookInfo,
 		}
 		return err
 	}
+	return w.ensureObjectCA(ctx, client, info, obj, caPem, untrustedPem)
+}
+
+// ensureSelectedWebhooksCA ensures ca for all resources which match info.LabelSelector
+func (w *webhookManager) ensureSelectedWebhooksCA(ctx context.Context, client resourceInterface, info WebhookInfo, caPem, untrustedPem []byte) error {
+	if _, err := labels.Parse(info.LabelSelector); err != nil {
+		return errors.Errorf("invalid label selector %q: %w", info.LabelSelector, err)
+	}
+	list, err := client.List(ctx, metav1.ListOptions{LabelSelector: info.LabelSelector})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			klog.Warningf("webhooks %s are not found skip ensure ca", info.displayName())
+			return nil
+		}
+		return err
+	}
+	if len(list.Items) == 0 {
+		klog.Warningf("no webhook is selected by %q skip ensure ca", info.LabelSelector)
+	}
+	for i := range list.Items {
+		if err := w.ensureObjectCA(ctx, client, info, &list.Items[i], caPem, untrustedPem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	changed, err := injectCertToWebhook(obj, caPem)
+func (w *webhookManager) ensureObjectCA(ctx context.Context, client resourceInterface, info WebhookInfo, obj *unstructured.Unstructured, caPem, untrustedPem []byte) error {
+	name := obj.GetName()
+	if name == "" {
+		name = info.Name
+	}
+	changed, err := info.injectCert(obj, caPem, untrustedPem, w.caBundleRetention)
 	if err != nil {
-		return errors.Errorf("ensure ca for webhook %s: %w", info.Name, err)
+		return errors.Errorf("ensure ca for webhook %s: %w", name, err)
 	}
 	if !changed {
-		klog.Warningf("no need to update ca for webhook %s", info.Name)
+		klog.Warningf("no need to update ca for webhook %s", name)
 		return nil
 	}
 	if _, err := client.Update(ctx, obj, metav1.UpdateOptions{}); err != nil {
 		if apierrors.IsNotFound(err) {
-			klog.Warningf("webhook %s is not found skip ensure ca", info.Name)
+			klog.Warningf("webhook %s is not found skip ensure ca", name)
 			return nil
 		}
-		return errors.Errorf("ensure ca for webhook %s: %w", info.Name, err)
+		return errors.Errorf("ensure ca for webhook %s: %w", name, err)
 	}
 	return nil
 }
 
 func (w *webhookManager) watchChanges(ctx context.Context, events chan<- watch.Event, webhook WebhookInfo, watchTimeout time.Duration) error {
-	gvs, err := webhook.Type.gvr()
+	gvs, err := webhook.gvr()
 	if err != nil {
 		return errors.Errorf(": %w", err)
 	}
-	nameSelector := fields.OneTermEqualSelector("metadata.name", webhook.Name).String()
 	client := w.resourceClientGetter(*gvs)
 	ts := int64(watchTimeout / time.Second)
-	watcher, err := client.Watch(ctx, metav1.ListOptions{
-		FieldSelector:  nameSelector,
+	opts := metav1.ListOptions{
 		Watch:          true,
 		TimeoutSeconds: &ts,
-	})
+	}
+	// the resources which match the selector are watched by one watch,
+	// the ones created later are received as Added events
+	if webhook.LabelSelector != "" {
+		opts.LabelSelector = webhook.LabelSelector
+	} else {
+		opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", webhook.Name).String()
+	}
+	watcher, err := client.Watch(ctx, opts)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			return err
 		}
-		return errors.Errorf("watch %s: %w", webhook.Name, err)
+		return errors.Errorf("watch %s: %w", webhook.displayName(), err)
 	}
 
 	w.watchInterfaceChanges(ctx, events, watcher)
@@ -154,6 +249,45 @@ loop:
 	intf.Stop()
 }
 
+func (info WebhookInfo) displayName() string {
+	if info.LabelSelector != "" {
+		return fmt.Sprintf("selected by %q", info.LabelSelector)
+	}
+	return info.Name
+}
+
+func (info WebhookInfo) gvr() (*schema.GroupVersionResource, error) {
+	if info.Resource == nil {
+		return info.Type.gvr()
+	}
+	if len(info.CABundlePaths) == 0 {
+		return nil, errors.Errorf("CABundlePaths of %s %s is required", info.Resource.Resource, info.Name)
+	}
+	if info.ClientConfigFilter != nil {
+		return nil, errors.Errorf("ClientConfigFilter of %s %s is not supported with Resource", info.Resource.Resource, info.Name)
+	}
+	return info.Resource, nil
+}
+
+func (info WebhookInfo) injectCert(obj *unstructured.Unstructured, caPem, untrustedPem []byte, retention CABundleRetention) (bool, error) {
+	if info.Resource == nil {
+		return info.Type.injectCert(obj, caPem, untrustedPem, retention, info.ClientConfigFilter)
+	}
+	changed := false
+	for _, p := range info.CABundlePaths {
+		path, err := parseFieldPath(p)
+		if err != nil {
+			return false, err
+		}
+		ch, err := injectCABundleAtPath(obj.Object, path, caPem, untrustedPem, retention)
+		if err != nil {
+			return false, errors.Errorf("inject caBundle to %s of %s %s: %w", p, obj.GetKind(), obj.GetName(), err)
+		}
+		changed = changed || ch
+	}
+	return changed, nil
+}
+
 func (t WebhookType) gvr() (*schema.GroupVersionResource, error) {
 	switch t {
 	case ValidatingV1:
@@ -180,11 +314,37 @@ func (t WebhookType) gvr() (*schema.GroupVersionResource, error) {
 			Version:  "v1beta1",
 			Resource: "mutatingwebhookconfigurations",
 		}, nil
+	case CRDConversionV1:
+		return &schema.GroupVersionResource{
+			Group:    "apiextensions.k8s.io",
+			Version:  "v1",
+			Resource: "customresourcedefinitions",
+		}, nil
+	case APIServiceV1:
+		return &schema.GroupVersionResource{
+			Group:    "apiregistration.k8s.io",
+			Version:  "v1",
+			Resource: "apiservices",
+		}, nil
 	}
 	return nil, errors.Errorf("unknown type: %s", t)
 }
 
-func injectCertToWebhook(wh *unstructured.Unstructured, caPem []byte) (changed bool, err error) {
+func (t WebhookType) injectCert(obj *unstructured.Unstructured, caPem, untrustedPem []byte, retention CABundleRetention, filter *ClientConfigFilter) (bool, error) {
+	if err := filter.validate(); err != nil {
+		return false, err
+	}
+	switch t {
+	case CRDConversionV1:
+		return injectCertToCRD(obj, caPem, untrustedPem, retention, filter)
+	case APIServiceV1:
+		return injectCertToAPIService(obj, caPem, untrustedPem, retention, filter)
+	}
+	return injectCertToWebhook(obj, caPem, untrustedPem, retention, filter)
+}
+
+func injectCertToWebhook(wh *unstructured.Unstructured, caPem, untrustedPem []byte, retention CABundleRetention, filter *ClientConfigFilter) (changed bool, err error) {
+	var skipped []string
 	webhooks, found, err := unstructured.NestedSlice(wh.Object, "webhooks")
 	if err != nil {
 		return false, errors.Errorf(": %w", err)
@@ -199,27 +359,228 @@ func injectCertToWebhook(wh *unstructured.Unstructured, caPem []byte) (changed b
 		if !ok {
 			return false, errors.Errorf("webhook %d is not well-formed", i)
 		}
-		var oldPem []byte
-		oldCABundle, found, err := unstructured.NestedString(hook, "clientConfig", "caBundle")
-		if err == nil && found {
-			b, err := base64.StdEncoding.DecodeString(oldCABundle)
-			if err == nil && len(bytes.TrimSpace(b)) != 0 {
-				oldPem = b
-			}
-		}
-		ch, certPem := mergeCAPemCerts(oldPem, caPem)
-		if len(certPem) == 0 || !ch {
+		if clientConfig, _, _ := unstructured.NestedMap(hook, "clientConfig"); !filter.match(clientConfig) {
+			name, _, _ := unstructured.NestedString(hook, "name")
+			skipped = append(skipped, name)
 			continue
-		} else {
-			changed = true
 		}
-		if err := unstructured.SetNestedField(hook, base64.StdEncoding.EncodeToString(certPem), "clientConfig", "caBundle"); err != nil {
-			return false, errors.Errorf(": %w", err)
+		ch, err := injectCABundle(hook, []string{"clientConfig", "caBundle"}, caPem, untrustedPem, retention)
+		if err != nil {
+			return false, err
 		}
+		if !ch {
+			continue
+		}
+		changed = true
 		webhooks[i] = hook
 	}
+	if len(skipped) != 0 {
+		klog.Infof("skip webhooks %v of %s %s, their clientConfig does not match ClientConfigFilter",
+			skipped, wh.GetKind(), wh.GetName())
+	}
 	if err := unstructured.SetNestedSlice(wh.Object, webhooks, "webhooks"); err != nil {
 		return false, errors.Errorf(": %w", err)
 	}
 	return changed, nil
 }
+
+func (f *ClientConfigFilter) validate() error {
+	if f != nil && f.ServiceName == "" && f.URLHost == "" {
+		return errors.New("ServiceName or URLHost of ClientConfigFilter is required")
+	}
+	return nil
+}
+
+// match reports whether clientConfig of a webhook matches f, nil f matches all webhooks
+func (f *ClientConfigFilter) match(clientConfig map[string]interface{}) bool {
+	if f == nil {
+		return true
+	}
+	if f.ServiceName != "" {
+		namespace, _, _ := unstructured.NestedString(clientConfig, "service", "namespace")
+		name, _, _ := unstructured.NestedString(clientConfig, "service", "name")
+		port, found, _ := unstructured.NestedInt64(clientConfig, "service", "port")
+		if !found {
+			port = 443
+		}
+		if name == f.ServiceName &&
+			(f.ServiceNamespace == "" || namespace == f.ServiceNamespace) &&
+			(f.ServicePort == 0 || port == int64(f.ServicePort)) {
+			return true
+		}
+	}
+	if f.URLHost != "" {
+		rawURL, found, _ := unstructured.NestedString(clientConfig, "url")
+		if !found {
+			return false
+		}
+		u, err := url.Parse(rawURL)
+		if err == nil && (u.Host == f.URLHost || u.Hostname() == f.URLHost) {
+			return true
+		}
+	}
+	return false
+}
+
+func injectCertToCRD(crd *unstructured.Unstructured, caPem, untrustedPem []byte, retention CABundleRetention, filter *ClientConfigFilter) (bool, error) {
+	webhook, found, err := unstructured.NestedMap(crd.Object, "spec", "conversion", "webhook")
+	if err != nil {
+		return false, errors.Errorf(": %w", err)
+	}
+	// the conversion strategy is None, skip it so that other webhooks are still patched
+	if !found {
+		klog.Warningf("`spec.conversion.webhook` field not found in %s %s, skip ensure ca", crd.GetKind(), crd.GetName())
+		return false, nil
+	}
+	if clientConfig, _, _ := unstructured.NestedMap(webhook, "clientConfig"); !filter.match(clientConfig) {
+		klog.Infof("skip %s %s, its conversion webhook does not match ClientConfigFilter", crd.GetKind(), crd.GetName())
+		return false, nil
+	}
+	return injectCABundle(crd.Object, []string{"spec", "conversion", "webhook", "clientConfig", "caBundle"}, caPem, untrustedPem, retention)
+}
+
+func injectCertToAPIService(svc *unstructured.Unstructured, caPem, untrustedPem []byte, retention CABundleRetention, filter *ClientConfigFilter) (bool, error) {
+	spec, found, err := unstructured.NestedMap(svc.Object, "spec")
+	if err != nil {
+		return false, errors.Errorf(": %w", err)
+	}
+	if !found {
+		return false, errors.Errorf("`spec` field not found in %s %s", svc.GetKind(), svc.GetName())
+	}
+	// caBundle is not allowed when insecureSkipTLSVerify is true, skip it so that other webhooks are still patched
+	if skip, _, _ := unstructured.NestedBool(svc.Object, "spec", "insecureSkipTLSVerify"); skip {
+		klog.Warningf("`spec.insecureSkipTLSVerify` of %s %s is true, skip ensure ca", svc.GetKind(), svc.GetName())
+		return false, nil
+	}
+	// spec.service of APIService has the same fields as clientConfig.service
+	if !filter.match(spec) {
+		klog.Infof("skip %s %s, its service does not match ClientConfigFilter", svc.GetKind(), svc.GetName())
+		return false, nil
+	}
+	return injectCABundle(svc.Object, []string{"spec", "caBundle"}, caPem, untrustedPem, retention)
+}
+
+// fieldPathSegment is a field of a path, e.g. `webhooks[*]`
+type fieldPathSegment struct {
+	name string
+	// the field is a list, the rest of the path is applied to all of its items
+	wildcard bool
+}
+
+func parseFieldPath(path string) ([]fieldPathSegment, error) {
+	var segments []fieldPathSegment
+	for _, field := range strings.Split(path, ".") {
+		seg := fieldPathSegment{name: field}
+		if strings.HasSuffix(field, "[*]") {
+			seg = fieldPathSegment{name: strings.TrimSuffix(field, "[*]"), wildcard: true}
+		}
+		if seg.name == "" || strings.ContainsAny(seg.name, "[]*") {
+			return nil, errors.Errorf("invalid field path %q", path)
+		}
+		segments = append(segments, seg)
+	}
+	if segments[len(segments)-1].wildcard {
+		return nil, errors.Errorf("invalid field path %q: the last field must not be a list", path)
+	}
+	return segments, nil
+}
+
+// injectCABundleAtPath merges caPem into the caBundle fields of obj which match path,
+// the fields before a caBundle field must exist, while a caBundle field is created if it does not exist
+func injectCABundleAtPath(obj map[string]interface{}, path []fieldPathSegment, caPem, untrustedPem []byte, retention CABundleRetention) (bool, error) {
+	i := 0
+	for i < len(path) && !path[i].wildcard {
+		i++
+	}
+	if i == len(path) {
+		fields := make([]string, 0, len(path))
+		for _, seg := range path {
+			fields = append(fields, seg.name)
+		}
+		if len(fields) > 1 {
+			if _, found, err := unstructured.NestedMap(obj, fields[:len(fields)-1]...); err != nil {
+				return false, errors.Errorf(": %w", err)
+			} else if !found {
+				return false, errors.Errorf("`%s` field not found", strings.Join(fields[:len(fields)-1], "."))
+			}
+		}
+		return injectCABundle(obj, fields, caPem, untrustedPem, retention)
+	}
+
+	fields := make([]string, 0, i+1)
+	for _, seg := range path[:i+1] {
+		fields = append(fields, seg.name)
+	}
+	items, found, err := unstructured.NestedSlice(obj, fields...)
+	if err != nil {
+		return false, errors.Errorf(": %w", err)
+	}
+	if !found {
+		return false, errors.Errorf("`%s` field not found", strings.Join(fields, "."))
+	}
+	changed := false
+	for j, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return false, errors.Errorf("item %d of `%s` is not well-formed", j, strings.Join(fields, "."))
+		}
+		ch, err := injectCABundleAtPath(m, path[i+1:], caPem, untrustedPem, retention)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || ch
+		items[j] = m
+	}
+	if err := unstructured.SetNestedSlice(obj, items, fields...); err != nil {
+		return false, errors.Errorf(": %w", err)
+	}
+	return changed, nil
+}
+
+// injectCABundle merges caPem into the base64 encoded caBundle at fields of obj
+func injectCABundle(obj map[string]interface{}, fields []string, caPem, untrustedPem []byte, retention CABundleRetention) (bool, error) {
+	var oldPem []byte
+	oldCABundle, found, err := unstructured.NestedString(obj, fields...)
+	if err == nil && found {
+		b, err := base64.StdEncoding.DecodeString(oldCABundle)
+		if err == nil && len(bytes.TrimSpace(b)) != 0 {
+			oldPem = b
+		}
+	}
+	changed, certPem := mergeCAPemCerts(oldPem, caPem, untrustedPem, retention)
+	if len(certPem) == 0 || !changed {
+		return false, nil
+	}
+	if err := unstructured.SetNestedField(obj, base64.StdEncoding.EncodeToString(certPem), fields...); err != nil {
+		return false, errors.Errorf(": %w", err)
+	}
+	return true, nil
+}
+
+func (r CABundleRetention) getMaxPreviousCAs() int {
+	if r.MaxPreviousCAs == 0 {
+		return 1
+	}
+	if r.MaxPreviousCAs < 0 {
+		return 0
+	}
+	return r.MaxPreviousCAs
+}
+
+// keep reports whether the old cert should be kept in caBundle
+func (r CABundleRetention) keep(raw []byte, now time.Time) bool {
+	if !r.PruneExpired && !r.PruneNonCA {
+		return true
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return false
+	}
+	if r.PruneExpired && now.After(cert.NotAfter) {
+		return false
+	}
+	if r.PruneNonCA && !cert.IsCA {
+		return false
+	}
+	return true
+}
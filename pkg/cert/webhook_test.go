@@ -2,6 +2,7 @@ package cert
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"strings"
@@ -186,7 +187,7 @@ func Test_injectCertToWebhook(t *testing.T) {
 			obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(tt.args.object)
 			wh := &unstructured.Unstructured{Object: obj}
 			assert.NoError(t, err)
-			changed, err := injectCertToWebhook(wh, tt.args.caPem)
+			changed, err := injectCertToWebhook(wh, tt.args.caPem, nil, CABundleRetention{}, nil)
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -211,6 +212,31 @@ func Test_injectCertToWebhook(t *testing.T) {
 	}
 }
 
+func Test_injectCertToWebhook_retention(t *testing.T) {
+	object := &v1.ValidatingWebhookConfiguration{
+		Webhooks: []v1.ValidatingWebhook{
+			{
+				Name: "test1",
+				ClientConfig: v1.WebhookClientConfig{
+					CABundle: []byte(caPemForTestB),
+				},
+			},
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	assert.NoError(t, err)
+	wh := &unstructured.Unstructured{Object: obj}
+
+	changed, err := injectCertToWebhook(wh, []byte(caPemForTestA), nil, CABundleRetention{PruneNonCA: true}, nil)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	finalObj := &v1.ValidatingWebhookConfiguration{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(wh.Object, finalObj)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.TrimSpace(caPemForTestA), strings.TrimSpace(string(finalObj.Webhooks[0].ClientConfig.CABundle)))
+}
+
 type mockResourceInterfaceData struct {
 	inputName string
 	inputData *unstructured.Unstructured
@@ -236,8 +262,13 @@ type mockResourceInterface struct {
 	getData    *mockResourceInterfaceData
 	updateData *mockResourceInterfaceData
 
-	w  *mockWatchInterface
-	we error
+	listOpts metav1.ListOptions
+	listData *unstructured.UnstructuredList
+	listErr  error
+
+	w         *mockWatchInterface
+	we        error
+	watchOpts metav1.ListOptions
 }
 
 func (m *mockResourceInterface) Get(ctx context.Context, name string, options metav1.GetOptions, subresources ...string) (*unstructured.Unstructured, error) {
@@ -252,7 +283,13 @@ func (m *mockResourceInterface) Update(ctx context.Context, obj *unstructured.Un
 	return m.updateData.data.DeepCopy(), m.updateData.err
 }
 
+func (m *mockResourceInterface) List(ctx context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	m.listOpts = opts
+	return m.listData.DeepCopy(), m.listErr
+}
+
 func (m *mockResourceInterface) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	m.watchOpts = opts
 	return m.w, m.we
 }
 
@@ -293,7 +330,7 @@ func Test_webhookManager_ensureCA_success(t *testing.T) {
 			return res
 		},
 	}
-	err = m.ensureCA(context.TODO(), []byte(caPemForTestA))
+	err = m.ensureCA(context.TODO(), []byte(caPemForTestA), nil)
 	assert.NoError(t, err)
 
 	assert.Equal(t, "test", res.getData.inputName)
@@ -320,7 +357,7 @@ func Test_webhookManager_ensureCA_skip_get_not_found(t *testing.T) {
 			return res
 		},
 	}
-	err := m.ensureCA(context.TODO(), []byte(caPemForTestA))
+	err := m.ensureCA(context.TODO(), []byte(caPemForTestA), nil)
 	assert.NoError(t, err)
 
 	assert.Equal(t, "test", res.getData.inputName)
@@ -363,7 +400,7 @@ func Test_webhookManager_ensureCA_skip_update_not_found(t *testing.T) {
 			return res
 		},
 	}
-	err = m.ensureCA(context.TODO(), []byte(caPemForTestA))
+	err = m.ensureCA(context.TODO(), []byte(caPemForTestA), nil)
 	assert.NoError(t, err)
 
 	assert.Equal(t, "test", res.getData.inputName)
@@ -390,7 +427,7 @@ func Test_webhookManager_ensureCA_retry_when_get_error(t *testing.T) {
 			return res
 		},
 	}
-	err := m.ensureCA(context.TODO(), []byte(caPemForTestA))
+	err := m.ensureCA(context.TODO(), []byte(caPemForTestA), nil)
 	assert.Error(t, err)
 	t.Log(err)
 
@@ -434,7 +471,7 @@ func Test_webhookManager_ensureCA_retry_when_update_error(t *testing.T) {
 			return res
 		},
 	}
-	err = m.ensureCA(context.TODO(), []byte(caPemForTestA))
+	err = m.ensureCA(context.TODO(), []byte(caPemForTestA), nil)
 	assert.Error(t, err)
 	t.Log(err)
 
@@ -511,3 +548,689 @@ func Test_webhookManager_watchChanges_receive_event(t *testing.T) {
 	case <-time.After(time.Second):
 	}
 }
+
+func newTestCRD(caBundle string) *unstructured.Unstructured {
+	clientConfig := map[string]interface{}{
+		"service": map[string]interface{}{
+			"namespace": "default",
+			"name":      "test",
+		},
+	}
+	if caBundle != "" {
+		clientConfig["caBundle"] = base64.StdEncoding.EncodeToString([]byte(caBundle))
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apiextensions.k8s.io/v1",
+		"kind":       "CustomResourceDefinition",
+		"metadata": map[string]interface{}{
+			"name": "foos.example.com",
+		},
+		"spec": map[string]interface{}{
+			"conversion": map[string]interface{}{
+				"strategy": "Webhook",
+				"webhook": map[string]interface{}{
+					"conversionReviewVersions": []interface{}{"v1"},
+					"clientConfig":             clientConfig,
+				},
+			},
+		},
+	}}
+}
+
+func crdCABundle(t *testing.T, crd *unstructured.Unstructured) string {
+	v, found, err := unstructured.NestedString(crd.Object, "spec", "conversion", "webhook", "clientConfig", "caBundle")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	b, err := base64.StdEncoding.DecodeString(v)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func Test_injectCertToCRD(t *testing.T) {
+	crd := newTestCRD("")
+	changed, err := CRDConversionV1.injectCert(crd, []byte(caPemForTestA), nil, CABundleRetention{}, nil)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, strings.TrimSpace(caPemForTestA), strings.TrimSpace(crdCABundle(t, crd)))
+	service, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "webhook", "clientConfig", "service", "name")
+	assert.Equal(t, "test", service)
+
+	// not changed
+	changed, err = CRDConversionV1.injectCert(crd, []byte(caPemForTestA), nil, CABundleRetention{}, nil)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// merge certs
+	crd = newTestCRD(caPemForTestB)
+	changed, err = CRDConversionV1.injectCert(crd, []byte(caPemForTestA), nil, CABundleRetention{}, nil)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, fmt.Sprintf("%s\n%s", strings.TrimSpace(caPemForTestA), strings.TrimSpace(caPemForTestB)),
+		strings.TrimSpace(crdCABundle(t, crd)))
+
+	// remove untrusted certs
+	changed, err = CRDConversionV1.injectCert(crd, []byte(caPemForTestA), []byte(caPemForTestB), CABundleRetention{}, nil)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, strings.TrimSpace(caPemForTestA), strings.TrimSpace(crdCABundle(t, crd)))
+
+	// conversion webhook is not configured
+	crd = newTestCRD("")
+	unstructured.RemoveNestedField(crd.Object, "spec", "conversion", "webhook")
+	assert.NoError(t, unstructured.SetNestedField(crd.Object, "None", "spec", "conversion", "strategy"))
+	changed, err = CRDConversionV1.injectCert(crd, []byte(caPemForTestA), nil, CABundleRetention{}, nil)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	_, found, _ := unstructured.NestedMap(crd.Object, "spec", "conversion", "webhook")
+	assert.False(t, found)
+}
+
+func Test_webhookManager_ensureCA_crd(t *testing.T) {
+	res := &mockResourceInterface{
+		getData: &mockResourceInterfaceData{
+			data: newTestCRD(caPemForTestB),
+		},
+		updateData: &mockResourceInterfaceData{
+			data: newTestCRD(""),
+		},
+	}
+	var gvr schema.GroupVersionResource
+	m := webhookManager{
+		webhooks: []WebhookInfo{
+			{
+				Type: CRDConversionV1,
+				Name: "foos.example.com",
+			},
+		},
+		resourceClientGetter: func(resource schema.GroupVersionResource) resourceInterface {
+			gvr = resource
+			return res
+		},
+	}
+	err := m.ensureCA(context.TODO(), []byte(caPemForTestA), []byte(caPemForTestB))
+	assert.NoError(t, err)
+
+	assert.Equal(t, schema.GroupVersionResource{
+		Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}, gvr)
+	assert.Equal(t, "foos.example.com", res.getData.inputName)
+	assert.Equal(t, 1, res.updateData.callCount)
+	assert.Equal(t, strings.TrimSpace(caPemForTestA), strings.TrimSpace(crdCABundle(t, res.updateData.inputData)))
+}
+
+func newTestAPIService(caBundle string) *unstructured.Unstructured {
+	spec := map[string]interface{}{
+		"group":   "example.com",
+		"version": "v1",
+		"service": map[string]interface{}{
+			"namespace": "default",
+			"name":      "test",
+		},
+		"groupPriorityMinimum": int64(1000),
+		"versionPriority":      int64(15),
+	}
+	if caBundle != "" {
+		spec["caBundle"] = base64.StdEncoding.EncodeToString([]byte(caBundle))
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apiregistration.k8s.io/v1",
+		"kind":       "APIService",
+		"metadata": map[string]interface{}{
+			"name": "v1.example.com",
+		},
+		"spec": spec,
+	}}
+}
+
+func apiServiceCABundle(t *testing.T, svc *unstructured.Unstructured) string {
+	v, found, err := unstructured.NestedString(svc.Object, "spec", "caBundle")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	b, err := base64.StdEncoding.DecodeString(v)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func Test_injectCertToAPIService(t *testing.T) {
+	svc := newTestAPIService("")
+	changed, err := APIServiceV1.injectCert(svc, []byte(caPemForTestA), nil, CABundleRetention{}, nil)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, strings.TrimSpace(caPemForTestA), strings.TrimSpace(apiServiceCABundle(t, svc)))
+
+	// not changed
+	changed, err = APIServiceV1.injectCert(svc, []byte(caPemForTestA), nil, CABundleRetention{}, nil)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// merge certs
+	svc = newTestAPIService(caPemForTestB)
+	changed, err = APIServiceV1.injectCert(svc, []byte(caPemForTestA), nil, CABundleRetention{}, nil)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, fmt.Sprintf("%s\n%s", strings.TrimSpace(caPemForTestA), strings.TrimSpace(caPemForTestB)),
+		strings.TrimSpace(apiServiceCABundle(t, svc)))
+
+	// caBundle is not allowed
+	svc = newTestAPIService("")
+	assert.NoError(t, unstructured.SetNestedField(svc.Object, true, "spec", "insecureSkipTLSVerify"))
+	changed, err = APIServiceV1.injectCert(svc, []byte(caPemForTestA), nil, CABundleRetention{}, nil)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	_, found, _ := unstructured.NestedString(svc.Object, "spec", "caBundle")
+	assert.False(t, found)
+
+	// spec is missing
+	svc = newTestAPIService("")
+	unstructured.RemoveNestedField(svc.Object, "spec")
+	_, err = APIServiceV1.injectCert(svc, []byte(caPemForTestA), nil, CABundleRetention{}, nil)
+	assert.Error(t, err)
+}
+
+func Test_webhookManager_ensureCA_apiservice(t *testing.T) {
+	res := &mockResourceInterface{
+		getData: &mockResourceInterfaceData{
+			data: newTestAPIService(caPemForTestB),
+		},
+		updateData: &mockResourceInterfaceData{
+			data: newTestAPIService(""),
+		},
+	}
+	var gvr schema.GroupVersionResource
+	m := webhookManager{
+		webhooks: []WebhookInfo{
+			{
+				Type: APIServiceV1,
+				Name: "v1.example.com",
+			},
+		},
+		resourceClientGetter: func(resource schema.GroupVersionResource) resourceInterface {
+			gvr = resource
+			return res
+		},
+	}
+	err := m.ensureCA(context.TODO(), []byte(caPemForTestA), []byte(caPemForTestB))
+	assert.NoError(t, err)
+
+	assert.Equal(t, schema.GroupVersionResource{
+		Group: "apiregistration.k8s.io", Version: "v1", Resource: "apiservices"}, gvr)
+	assert.Equal(t, "v1.example.com", res.getData.inputName)
+	assert.Equal(t, 1, res.updateData.callCount)
+	assert.Equal(t, strings.TrimSpace(caPemForTestA), strings.TrimSpace(apiServiceCABundle(t, res.updateData.inputData)))
+}
+
+func Test_parseFieldPath(t *testing.T) {
+	path, err := parseFieldPath("webhooks[*].clientConfig.caBundle")
+	assert.NoError(t, err)
+	assert.Equal(t, []fieldPathSegment{
+		{name: "webhooks", wildcard: true},
+		{name: "clientConfig"},
+		{name: "caBundle"},
+	}, path)
+
+	path, err = parseFieldPath("spec.caBundle")
+	assert.NoError(t, err)
+	assert.Equal(t, []fieldPathSegment{{name: "spec"}, {name: "caBundle"}}, path)
+
+	for _, p := range []string{"", "spec..caBundle", "[*].caBundle", "webhooks[0].caBundle", "spec.caBundles[*]"} {
+		_, err := parseFieldPath(p)
+		assert.Error(t, err, p)
+	}
+}
+
+func Test_WebhookInfo_injectCert_custom_resource(t *testing.T) {
+	info := WebhookInfo{
+		Name:     "test",
+		Resource: &schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "foos"},
+		CABundlePaths: []string{
+			"spec.hooks[*].targets[*].caBundle",
+			"spec.caBundle",
+		},
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Foo",
+		"metadata": map[string]interface{}{
+			"name": "test",
+		},
+		"spec": map[string]interface{}{
+			"hooks": []interface{}{
+				map[string]interface{}{
+					"targets": []interface{}{
+						map[string]interface{}{"name": "a"},
+						map[string]interface{}{
+							"name":     "b",
+							"caBundle": base64.StdEncoding.EncodeToString([]byte(caPemForTestB)),
+						},
+					},
+				},
+				map[string]interface{}{
+					"targets": []interface{}{},
+				},
+			},
+		},
+	}}
+	bundle := func(fields ...string) string {
+		v, found, err := unstructured.NestedString(obj.Object, fields...)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		b, err := base64.StdEncoding.DecodeString(v)
+		assert.NoError(t, err)
+		return strings.TrimSpace(string(b))
+	}
+	targets := func() []interface{} {
+		hooks, _, _ := unstructured.NestedSlice(obj.Object, "spec", "hooks")
+		targets, _, _ := unstructured.NestedSlice(hooks[0].(map[string]interface{}), "targets")
+		return targets
+	}
+
+	gvr, err := info.gvr()
+	assert.NoError(t, err)
+	assert.Equal(t, info.Resource, gvr)
+
+	changed, err := info.injectCert(obj, []byte(caPemForTestA), []byte(caPemForTestB), CABundleRetention{})
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, strings.TrimSpace(caPemForTestA), bundle("spec", "caBundle"))
+	ts := targets()
+	assert.Len(t, ts, 2)
+	for _, target := range ts {
+		v, _, _ := unstructured.NestedString(target.(map[string]interface{}), "caBundle")
+		b, _ := base64.StdEncoding.DecodeString(v)
+		assert.Equal(t, strings.TrimSpace(caPemForTestA), strings.TrimSpace(string(b)))
+	}
+	name, _, _ := unstructured.NestedString(ts[1].(map[string]interface{}), "name")
+	assert.Equal(t, "b", name)
+
+	// not changed
+	changed, err = info.injectCert(obj, []byte(caPemForTestA), []byte(caPemForTestB), CABundleRetention{})
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// field not found
+	info.CABundlePaths = []string{"spec.webhook.clientConfig.caBundle"}
+	_, err = info.injectCert(obj, []byte(caPemForTestA), nil, CABundleRetention{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "`spec.webhook.clientConfig` field not found")
+
+	info.CABundlePaths = []string{"spec.webhooks[*].caBundle"}
+	_, err = info.injectCert(obj, []byte(caPemForTestA), nil, CABundleRetention{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "`spec.webhooks` field not found")
+
+	// paths are required
+	info.CABundlePaths = nil
+	_, err = info.gvr()
+	assert.Error(t, err)
+
+	// ClientConfigFilter is not supported
+	info.CABundlePaths = []string{"webhooks[*].caBundle"}
+	info.ClientConfigFilter = &ClientConfigFilter{ServiceName: "test"}
+	_, err = info.gvr()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ClientConfigFilter")
+}
+
+func Test_webhookManager_ensureCA_custom_resource(t *testing.T) {
+	object := &v1.ValidatingWebhookConfiguration{
+		Webhooks: []v1.ValidatingWebhook{{Name: "test1"}, {Name: "test2"}},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	assert.NoError(t, err)
+	res := &mockResourceInterface{
+		getData: &mockResourceInterfaceData{
+			data: &unstructured.Unstructured{Object: obj},
+		},
+		updateData: &mockResourceInterfaceData{
+			data: &unstructured.Unstructured{Object: obj},
+		},
+	}
+	resource := schema.GroupVersionResource{Group: "admissionregistration.k8s.io", Version: "v1", Resource: "validatingwebhookconfigurations"}
+	var gvr schema.GroupVersionResource
+	m := webhookManager{
+		webhooks: []WebhookInfo{
+			{
+				Name:          "test",
+				Resource:      &resource,
+				CABundlePaths: []string{"webhooks[*].clientConfig.caBundle"},
+			},
+		},
+		resourceClientGetter: func(resource schema.GroupVersionResource) resourceInterface {
+			gvr = resource
+			return res
+		},
+	}
+	err = m.ensureCA(context.TODO(), []byte(caPemForTestA), nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, resource, gvr)
+	assert.Equal(t, 1, res.updateData.callCount)
+	updated := &v1.ValidatingWebhookConfiguration{}
+	assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(res.updateData.inputData.Object, updated))
+	assert.Len(t, updated.Webhooks, 2)
+	for _, h := range updated.Webhooks {
+		assert.Equal(t, strings.TrimSpace(caPemForTestA), strings.TrimSpace(string(h.ClientConfig.CABundle)))
+	}
+}
+
+func newTestValidatingWebhookConfiguration(t *testing.T, name string, caBundle string) unstructured.Unstructured {
+	object := &v1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"app.kubernetes.io/instance": "test"},
+		},
+		Webhooks: []v1.ValidatingWebhook{
+			{
+				Name:         "test1",
+				ClientConfig: v1.WebhookClientConfig{CABundle: []byte(caBundle)},
+			},
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	assert.NoError(t, err)
+	return unstructured.Unstructured{Object: obj}
+}
+
+type recordUpdateResource struct {
+	*mockResourceInterface
+	updated []string
+}
+
+func (r *recordUpdateResource) Update(ctx context.Context, obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	r.updated = append(r.updated, obj.GetName())
+	return obj, nil
+}
+
+func Test_webhookManager_ensureCA_label_selector(t *testing.T) {
+	res := &recordUpdateResource{
+		mockResourceInterface: &mockResourceInterface{
+			listData: &unstructured.UnstructuredList{Items: []unstructured.Unstructured{
+				newTestValidatingWebhookConfiguration(t, "release-a", ""),
+				newTestValidatingWebhookConfiguration(t, "release-b", caPemForTestA),
+				newTestValidatingWebhookConfiguration(t, "release-c", caPemForTestB),
+			}},
+		},
+	}
+	m := webhookManager{
+		webhooks: []WebhookInfo{
+			{
+				Type:          ValidatingV1,
+				LabelSelector: "app.kubernetes.io/instance=test",
+			},
+		},
+		resourceClientGetter: func(resource schema.GroupVersionResource) resourceInterface {
+			return res
+		},
+	}
+	err := m.ensureCA(context.TODO(), []byte(caPemForTestA), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "app.kubernetes.io/instance=test", res.listOpts.LabelSelector)
+	assert.Equal(t, []string{"release-a", "release-c"}, res.updated)
+
+	// no webhook is selected
+	res.updated = nil
+	res.listData = &unstructured.UnstructuredList{}
+	err = m.ensureCA(context.TODO(), []byte(caPemForTestA), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, res.updated)
+
+	// invalid selector
+	m.webhooks[0].LabelSelector = "a=b=c"
+	err = m.ensureCA(context.TODO(), []byte(caPemForTestA), nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid label selector")
+}
+
+func Test_webhookManager_watchChanges_label_selector(t *testing.T) {
+	watcher := &mockWatchInterface{events: make(chan watch.Event, 10)}
+	res := &mockResourceInterface{w: watcher}
+	m := webhookManager{
+		resourceClientGetter: func(resource schema.GroupVersionResource) resourceInterface {
+			return res
+		},
+	}
+	close(watcher.events)
+	err := m.watchChanges(context.TODO(), make(chan watch.Event), WebhookInfo{
+		Type:          MutatingV1,
+		LabelSelector: "app.kubernetes.io/instance=test",
+	}, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "app.kubernetes.io/instance=test", res.watchOpts.LabelSelector)
+	assert.Empty(t, res.watchOpts.FieldSelector)
+
+	watcher = &mockWatchInterface{events: make(chan watch.Event, 10)}
+	res.w = watcher
+	close(watcher.events)
+	err = m.watchChanges(context.TODO(), make(chan watch.Event), WebhookInfo{
+		Type: MutatingV1,
+		Name: "test",
+	}, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "metadata.name=test", res.watchOpts.FieldSelector)
+	assert.Empty(t, res.watchOpts.LabelSelector)
+}
+
+func TestClientConfigFilter_match(t *testing.T) {
+	port := int32(8443)
+	service := func(namespace, name string, port *int32) map[string]interface{} {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&v1.WebhookClientConfig{
+			Service: &v1.ServiceReference{Namespace: namespace, Name: name, Port: port},
+		})
+		assert.NoError(t, err)
+		return obj
+	}
+	url := func(u string) map[string]interface{} {
+		return map[string]interface{}{"url": u}
+	}
+	tests := []struct {
+		name         string
+		filter       *ClientConfigFilter
+		clientConfig map[string]interface{}
+		want         bool
+	}{
+		{
+			name:         "nil filter",
+			clientConfig: url("https://other.example.com/validate"),
+			want:         true,
+		},
+		{
+			name:         "service",
+			filter:       &ClientConfigFilter{ServiceNamespace: "default", ServiceName: "test"},
+			clientConfig: service("default", "test", &port),
+			want:         true,
+		},
+		{
+			name:         "service any namespace",
+			filter:       &ClientConfigFilter{ServiceName: "test"},
+			clientConfig: service("other", "test", nil),
+			want:         true,
+		},
+		{
+			name:         "service namespace not match",
+			filter:       &ClientConfigFilter{ServiceNamespace: "default", ServiceName: "test"},
+			clientConfig: service("other", "test", nil),
+			want:         false,
+		},
+		{
+			name:         "service name not match",
+			filter:       &ClientConfigFilter{ServiceNamespace: "default", ServiceName: "test"},
+			clientConfig: service("default", "other", nil),
+			want:         false,
+		},
+		{
+			name:         "service port",
+			filter:       &ClientConfigFilter{ServiceName: "test", ServicePort: 8443},
+			clientConfig: service("default", "test", &port),
+			want:         true,
+		},
+		{
+			name:         "service default port",
+			filter:       &ClientConfigFilter{ServiceName: "test", ServicePort: 443},
+			clientConfig: service("default", "test", nil),
+			want:         true,
+		},
+		{
+			name:         "service port not match",
+			filter:       &ClientConfigFilter{ServiceName: "test", ServicePort: 443},
+			clientConfig: service("default", "test", &port),
+			want:         false,
+		},
+		{
+			name:         "url host",
+			filter:       &ClientConfigFilter{URLHost: "webhook.example.com"},
+			clientConfig: url("https://webhook.example.com:8443/validate"),
+			want:         true,
+		},
+		{
+			name:         "url host and port",
+			filter:       &ClientConfigFilter{URLHost: "webhook.example.com:8443"},
+			clientConfig: url("https://webhook.example.com:8443/validate"),
+			want:         true,
+		},
+		{
+			name:         "url host not match",
+			filter:       &ClientConfigFilter{URLHost: "webhook.example.com"},
+			clientConfig: url("https://other.example.com/validate"),
+			want:         false,
+		},
+		{
+			name:         "url filter with service",
+			filter:       &ClientConfigFilter{URLHost: "webhook.example.com"},
+			clientConfig: service("default", "test", nil),
+			want:         false,
+		},
+		{
+			name:         "service or url",
+			filter:       &ClientConfigFilter{ServiceName: "test", URLHost: "webhook.example.com"},
+			clientConfig: url("https://webhook.example.com/validate"),
+			want:         true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.match(tt.clientConfig))
+		})
+	}
+}
+
+func Test_injectCertToWebhook_client_config_filter(t *testing.T) {
+	otherURL := "https://other.example.com/validate"
+	object := &v1.ValidatingWebhookConfiguration{
+		Webhooks: []v1.ValidatingWebhook{
+			{
+				Name: "ours",
+				ClientConfig: v1.WebhookClientConfig{
+					Service: &v1.ServiceReference{Namespace: "default", Name: "test"},
+				},
+			},
+			{
+				Name: "other-service",
+				ClientConfig: v1.WebhookClientConfig{
+					Service:  &v1.ServiceReference{Namespace: "default", Name: "other"},
+					CABundle: []byte(caPemForTestB),
+				},
+			},
+			{
+				Name: "other-url",
+				ClientConfig: v1.WebhookClientConfig{
+					URL: &otherURL,
+				},
+			},
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	assert.NoError(t, err)
+	wh := &unstructured.Unstructured{Object: obj}
+
+	filter := &ClientConfigFilter{ServiceNamespace: "default", ServiceName: "test"}
+	changed, err := injectCertToWebhook(wh, []byte(caPemForTestA), []byte(caPemForTestB), CABundleRetention{}, filter)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	updated := &v1.ValidatingWebhookConfiguration{}
+	assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(wh.Object, updated))
+	assert.Equal(t, strings.TrimSpace(caPemForTestA), strings.TrimSpace(string(updated.Webhooks[0].ClientConfig.CABundle)))
+	assert.Equal(t, caPemForTestB, string(updated.Webhooks[1].ClientConfig.CABundle))
+	assert.Empty(t, updated.Webhooks[2].ClientConfig.CABundle)
+
+	// no webhook matches
+	changed, err = injectCertToWebhook(wh, []byte(caPemForTestA), nil, CABundleRetention{},
+		&ClientConfigFilter{URLHost: "webhook.example.com"})
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// empty filter
+	_, err = ValidatingV1.injectCert(wh, []byte(caPemForTestA), nil, CABundleRetention{}, &ClientConfigFilter{})
+	assert.Error(t, err)
+}
+
+func TestWebhookType_injectCert_client_config_filter(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      WebhookType
+		obj      func() *unstructured.Unstructured
+		caBundle func(t *testing.T, obj *unstructured.Unstructured) string
+	}{
+		{
+			name:     "crd",
+			typ:      CRDConversionV1,
+			obj:      func() *unstructured.Unstructured { return newTestCRD("") },
+			caBundle: crdCABundle,
+		},
+		{
+			name:     "apiservice",
+			typ:      APIServiceV1,
+			obj:      func() *unstructured.Unstructured { return newTestAPIService("") },
+			caBundle: apiServiceCABundle,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := tt.obj()
+			changed, err := tt.typ.injectCert(obj, []byte(caPemForTestA), nil, CABundleRetention{},
+				&ClientConfigFilter{ServiceNamespace: "default", ServiceName: "test"})
+			assert.NoError(t, err)
+			assert.True(t, changed)
+			assert.Equal(t, strings.TrimSpace(caPemForTestA), strings.TrimSpace(tt.caBundle(t, obj)))
+
+			// the service does not match
+			obj = tt.obj()
+			changed, err = tt.typ.injectCert(obj, []byte(caPemForTestA), nil, CABundleRetention{},
+				&ClientConfigFilter{ServiceName: "other"})
+			assert.NoError(t, err)
+			assert.False(t, changed)
+			assert.Equal(t, tt.obj(), obj)
+
+			_, err = tt.typ.injectCert(obj, []byte(caPemForTestA), nil, CABundleRetention{}, &ClientConfigFilter{})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_webhookManager_ensureCA_skip_insecure_apiservice(t *testing.T) {
+	svc := newTestAPIService("")
+	assert.NoError(t, unstructured.SetNestedField(svc.Object, true, "spec", "insecureSkipTLSVerify"))
+	svcRes := &mockResourceInterface{
+		getData:    &mockResourceInterfaceData{data: svc},
+		updateData: &mockResourceInterfaceData{},
+	}
+	crdRes := &mockResourceInterface{
+		getData:    &mockResourceInterfaceData{data: newTestCRD("")},
+		updateData: &mockResourceInterfaceData{data: newTestCRD("")},
+	}
+	m := webhookManager{
+		webhooks: []WebhookInfo{
+			{Type: APIServiceV1, Name: "v1.example.com"},
+			{Type: CRDConversionV1, Name: "foos.example.com"},
+		},
+		resourceClientGetter: func(resource schema.GroupVersionResource) resourceInterface {
+			if resource.Resource == "apiservices" {
+				return svcRes
+			}
+			return crdRes
+		},
+	}
+	err := m.ensureCA(context.TODO(), []byte(caPemForTestA), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, svcRes.updateData.callCount)
+	assert.Equal(t, 1, crdRes.updateData.callCount)
+}